@@ -0,0 +1,205 @@
+package ukcp
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// ErrIdleTimeout is what Read and Write return once the peer was silent for
+// longer than the idle timeout, a normal close gives other errors
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrDeadLink is what Read and Write return once kcp sent a segment
+// DeadLink times without getting an ack, the peer is taken for gone
+var ErrDeadLink = errors.New("dead link")
+
+const defaultIdleTimeout = 30 * time.Second
+
+// Config holds the session settings, the zero value keeps the defaults
+type Config struct {
+	// KeepAlive is how often a Ping goes out when there is nothing else
+	// to send, 1200ms if 0
+	KeepAlive time.Duration
+	// IdleTimeout closes a session that heard nothing from its peer for
+	// that long. The dialer sends its value in FirstSYN with a one second
+	// resolution, a listener with 0 takes it from there, 30s otherwise
+	IdleTimeout time.Duration
+	// OnIdle is called on a goroutine of its own when the idle timeout
+	// closed the session
+	OnIdle func(session *UDPMakeSession)
+	// DeadLink is how many times kcp sends a segment before the session
+	// closes with ErrDeadLink, long before the idle timeout when the peer
+	// is gone while data is in flight. Keepalive Pings of an otherwise
+	// idle session do not count, the idle timeout finds that peer gone.
+	// 0 keeps kcp's 10
+	DeadLink int
+	// RtoPolicy bounds the rto, sets how it backs off and how often fast
+	// acks may resend a segment, the zero value keeps what NoDelay picks.
+	// It is not negotiated, each side resends its own way
+	RtoPolicy ikcp.RtoPolicy
+	// MinVersion and MaxVersion narrow the wire format versions the
+	// handshake may settle on, 0 means no limit on that side
+	MinVersion Version
+	MaxVersion Version
+	// MTU, SndWnd, RcvWnd and NoDelay go to kcp, from version 0.2 on they
+	// are negotiated: the smaller MTU wins, a send window never exceeds the
+	// peer's receive window and the listener's NoDelay wins over the
+	// dialer's. 0 and nil keep the defaults, kcp's MTU and 128 packets
+	MTU     int
+	SndWnd  int
+	RcvWnd  int
+	NoDelay *NoDelay
+	// RcvBufMax turns receive window autotuning on: every rtt the window
+	// becomes twice what the application read, up to that many bytes. A
+	// peer that left SndWnd at 0 lets its send window go as far when it
+	// runs a congestion window, NoDelay.NC 0, otherwise it stays at 128.
+	// 0 keeps the window at RcvWnd
+	RcvBufMax int
+	// AckPolicy is how this side acks what it receives, the zero value
+	// acks on every kcp flush. AckFrequency asks the peer to ack what this
+	// side sends that way instead, the sender knows best what it needs.
+	// Asking is part of the full handshake, a resumption keeps AckPolicy
+	AckPolicy    ikcp.AckPolicy
+	AckFrequency *ikcp.AckPolicy
+	// DiscoverMTU probes the path for the largest datagram that gets
+	// through and moves kcp's MTU along, see PathMTU
+	DiscoverMTU bool
+	// StreamMode puts kcp in stream mode for sessions of 0.6 and later,
+	// the listener turns it on when either side asks. It fills segments
+	// for bulk transfers, at the cost of a length on every message
+	StreamMode bool
+	// Ticket resumes a session with what ResumptionTicket gave before,
+	// skipping the handshake, a dialer without it does the full one
+	Ticket []byte
+	// TicketKey seals the tickets of a listener, 16, 24 or 32 bytes,
+	// listeners sharing an address behind a balancer need the same one.
+	// A random key is made if nil, tickets then die with the listener
+	TicketKey []byte
+	// Disable0RTT makes a listener refuse early data, as it can be
+	// replayed, the dialer then writes it after the resumption
+	Disable0RTT bool
+	// Clock is where sessions take the time from, for kcp, their timers,
+	// deadlines and handshake retries, the system clock if nil. A fake one
+	// wants a PacketConn on the same clock, like those of ukcptest
+	Clock ikcp.Clock
+}
+
+func (c *Config) keepAlive() time.Duration {
+	if c.KeepAlive > 0 {
+		return c.KeepAlive
+	}
+	return keepAliveInterval
+}
+
+func (c *Config) clock() ikcp.Clock {
+	if c.Clock == nil {
+		return ikcp.SystemClock
+	}
+	return c.Clock
+}
+
+// apply sets what the config decides on a new session, the lock must be held
+func (c *Config) apply(session *UDPMakeSession) {
+	session.keepAlive = c.keepAlive()
+	if c.IdleTimeout > 0 {
+		session.idleTimeout = c.IdleTimeout
+	}
+	session.onIdle = c.OnIdle
+	session.deadLink = c.DeadLink
+	session.ackPolicy = c.AckPolicy
+	session.rtoPolicy = c.RtoPolicy
+	if c.DiscoverMTU {
+		session.pmtud = &pmtud{}
+	}
+}
+
+// idle timeout in whole seconds as FirstSYN carries it
+func timeoutByte(d time.Duration) int {
+	sec := int(d / time.Second)
+	if sec < 1 {
+		sec = 1
+	} else if sec > 255 {
+		sec = 255
+	}
+	return sec
+}
+
+// SetKeepAlive changes the Ping interval of the session
+func (session *UDPMakeSession) SetKeepAlive(d time.Duration) {
+	if d <= 0 {
+		d = keepAliveInterval
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.keepAlive = d
+	if session.status == "ok" && !session.isQuit() {
+		session.pingTimer.reset(session.nextPing(session.wheel.now().UnixNano()))
+	}
+}
+
+// SetIdleTimeout changes how long the session waits for its peer, it only
+// applies to this side, the peer keeps its own
+func (session *UDPMakeSession) SetIdleTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultIdleTimeout
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.idleTimeout = d
+	if session.status == "ok" && !session.isQuit() {
+		session.pingTimer.reset(session.nextPing(session.wheel.now().UnixNano()))
+	}
+}
+
+// SetDeadLink changes how many times a segment goes out before the session
+// closes with ErrDeadLink, 0 restores kcp's default
+func (session *UDPMakeSession) SetDeadLink(n int) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.deadLink = n
+	if session.kcp != nil && !session.pingsOnly {
+		session.kcp.SetDeadLink(int32(n))
+	}
+}
+
+// SetRtoPolicy changes how kcp resends, the zero value restores its default
+func (session *UDPMakeSession) SetRtoPolicy(p ikcp.RtoPolicy) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.rtoPolicy = p
+	if session.kcp != nil {
+		session.kcp.SetRtoPolicy(p)
+	}
+}
+
+// nextPing is when onPing has to run again, for a Ping or for the idle check
+func (session *UDPMakeSession) nextPing(now int64) time.Duration {
+	next := session.keepAlive - time.Duration(now-session.lastPing)
+	if idle := session.idleTimeout - time.Duration(now-session.lastRecv); idle < next {
+		next = idle
+	}
+	return next
+}
+
+// idleClose gives up on a silent peer, the lock must be held
+func (session *UDPMakeSession) idleClose() {
+	log.Println("idle timeout close", session.LocalAddr().String(), session.RemoteAddr().String())
+	session.closeErr = ErrIdleTimeout
+	session.closeBegin()
+	if session.onIdle != nil {
+		go session.onIdle(session)
+	}
+}
+
+// deadClose gives up on a peer that stopped acking, there is no point in
+// a Close it will not ack either, the lock must be held
+func (session *UDPMakeSession) deadClose() {
+	log.Println("dead link close", session.LocalAddr().String(), session.RemoteAddr().String())
+	if !session.closed {
+		session.closeErr = ErrDeadLink
+	}
+	session.closeOver()
+}
@@ -0,0 +1,171 @@
+package ukcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := (&ListenConfig{Config: Config{KeepAlive: 100 * time.Millisecond}}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *UDPMakeSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.(*UDPMakeSession)
+	}()
+	idle := make(chan *UDPMakeSession, 1)
+	session, err := DialWithConfig(l.Addr().String(), &Config{
+		KeepAlive:   100 * time.Millisecond,
+		IdleTimeout: time.Second,
+		OnIdle:      func(s *UDPMakeSession) { idle <- s },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server := <-accepted
+	server.lock.Lock()
+	timeout := server.idleTimeout
+	server.lock.Unlock()
+	if timeout != time.Second {
+		t.Error("idle timeout not taken from FirstSYN", timeout)
+	}
+	//the keepalive holds an otherwise silent session
+	time.Sleep(1500 * time.Millisecond)
+	if session.isQuit() {
+		t.Fatal("closed while the peer was alive")
+	}
+	//the server vanishes without a word
+	l.Close()
+	start := time.Now()
+	_, err = session.Read(make([]byte, 10))
+	if err != ErrIdleTimeout {
+		t.Error("read after idle", err)
+	}
+	if d := time.Since(start); d < 800*time.Millisecond || d > 3*time.Second {
+		t.Error("idle close after", d)
+	}
+	select {
+	case s := <-idle:
+		if s != session {
+			t.Error("OnIdle got another session")
+		}
+	case <-time.After(time.Second):
+		t.Error("OnIdle not called")
+	}
+	if _, err := session.Write([]byte("x")); err != ErrIdleTimeout {
+		t.Error("write after idle", err)
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := DialWithConfig(l.Addr().String(), &Config{DeadLink: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	//the peer is gone while data is in flight, kcp gives up long before the idle timeout
+	l.Close()
+	start := time.Now()
+	if _, err := session.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Read(make([]byte, 10))
+	if err != ErrDeadLink {
+		t.Error("read after dead link", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("dead link close after", d)
+	}
+	if _, err := session.Write([]byte("x")); err != ErrDeadLink {
+		t.Error("write after dead link", err)
+	}
+}
+
+func TestDeadLinkAfterIdle(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	w := newTimerWheel(ikcp.SystemClock)
+	w.stop()
+	//nobody listens there, the keepalive Ping is never acked
+	session := newSession(sock, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, w)
+	session.id = 1
+	session.version = maxVersion
+	session.deadLink = 4
+	session.rtoPolicy = ikcp.RtoPolicy{Min: 100, Max: 200, Backoff: 1}
+	session.lock.Lock()
+	session.start()
+	session.idleTimeout = time.Minute
+	session.lastPing = 0
+	session.lock.Unlock()
+	session.onPing()
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.pingsOnly {
+		t.Fatal("keepalive did not turn the dead link off")
+	}
+	cur := uint32(0)
+	step := func(until uint32) {
+		for ; cur < until; cur += 10 {
+			session.kcp.Update(cur)
+		}
+	}
+	//the Ping goes out far more than deadLink times while idle
+	step(3000)
+	//writing again brings the dead link back, only counting from here
+	session.sendMessage(makeEncode(make([]byte, 5), Data, 0))
+	step(3300)
+	if session.kcp.IsDead() {
+		t.Error("dead right after the first write")
+	}
+	step(6000)
+	if !session.kcp.IsDead() {
+		t.Error("dead link not back after the write")
+	}
+}
+
+func TestRtoPolicy(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := DialWithConfig(l.Addr().String(), &Config{DeadLink: 8, RtoPolicy: ikcp.RtoPolicy{Min: 500}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.lock.Lock()
+	rto := session.kcp.Rto()
+	session.lock.Unlock()
+	if rto < 500 {
+		t.Fatal("rto below the minimum", rto)
+	}
+	//a tight cap without backoff resends often enough to give up quickly
+	session.SetRtoPolicy(ikcp.RtoPolicy{Min: 20, Max: 40, Backoff: 1})
+	l.Close()
+	start := time.Now()
+	if _, err := session.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = session.Read(make([]byte, 10)); err != ErrDeadLink {
+		t.Error("read after dead link", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("dead link close after", d)
+	}
+}
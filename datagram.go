@@ -0,0 +1,175 @@
+package ukcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// datagrams skip kcp: [conv 4 bytes][DatagramFrame][payload], kcp puts
+// its cmd where the status byte is, so the two never mix up
+const datagramHeader = 5
+
+// datagrams kept for ReceiveDatagram, the oldest go first when it is full
+const datagramQueueLimit = 256
+
+var errDatagramTooLarge = errors.New("datagram larger than the path mtu")
+var errDatagramEmpty = errors.New("empty datagram")
+
+type datagrams struct {
+	queue   [][]byte
+	wake    chan bool
+	waiting int
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+}
+
+func (session *UDPMakeSession) getDatagrams() *datagrams {
+	if session.datagrams == nil {
+		session.datagrams = &datagrams{wake: make(chan bool)}
+	}
+	return session.datagrams
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetDatagramKey seals datagrams with AES-GCM, key is 16, 24 or 32 bytes
+// and both sides need the same one, nil sends them in the clear again
+func (session *UDPMakeSession) SetDatagramKey(key []byte) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	d := session.getDatagrams()
+	if key == nil {
+		d.aead = nil
+		return nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	//a random prefix and a counter keep nonces unique, the low bit
+	//of the prefix tells the two directions apart as they share the key
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:4]); err != nil {
+		return err
+	}
+	nonce[0] &^= 1
+	if session.shard != nil {
+		nonce[0] |= 1
+	}
+	d.aead = aead
+	d.nonce = nonce
+	d.counter = 0
+	return nil
+}
+
+// MaxDatagramSize is the largest payload SendDatagram takes on this path
+func (session *UDPMakeSession) MaxDatagramSize() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.maxDatagramSize()
+}
+
+func (session *UDPMakeSession) maxDatagramSize() int {
+	n := int(session.kcp.Mtu()) - datagramHeader
+	if d := session.datagrams; d != nil && d.aead != nil {
+		n -= d.aead.NonceSize() + d.aead.Overhead()
+	}
+	return n
+}
+
+// SendDatagram sends b once, unordered and without retransmission, not to
+// peers that only speak 0.1
+func (session *UDPMakeSession) SendDatagram(b []byte) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.closed || session.status != "ok" {
+		return session.writeErr()
+	}
+	if session.version < framesVersion {
+		return errOldVersion
+	}
+	if len(b) == 0 {
+		return errDatagramEmpty
+	}
+	if len(b) > session.maxDatagramSize() {
+		return errDatagramTooLarge
+	}
+	buf := make([]byte, datagramHeader, datagramHeader+len(b)+64)
+	binary.LittleEndian.PutUint32(buf, uint32(session.id))
+	buf[4] = DatagramFrame
+	if d := session.datagrams; d != nil && d.aead != nil {
+		d.counter++
+		binary.LittleEndian.PutUint64(d.nonce[4:], d.counter)
+		buf = append(buf, d.nonce...)
+		buf = d.aead.Seal(buf, d.nonce, b, buf[:datagramHeader])
+	} else {
+		buf = append(buf, b...)
+	}
+	_, err := session.sock.WriteTo(buf, session.remote)
+	return err
+}
+
+// ReceiveDatagram waits for the next datagram, it honors the read deadline
+func (session *UDPMakeSession) ReceiveDatagram() ([]byte, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	d := session.getDatagrams()
+	for len(d.queue) == 0 {
+		if session.isQuit() {
+			return nil, session.readErr()
+		}
+		d.waiting++
+		err := session.wait(d.wake, session.readDeadline)
+		d.waiting--
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := d.queue[0]
+	d.queue[0] = nil
+	d.queue = d.queue[1:]
+	return b, nil
+}
+
+func isDatagram(data []byte) bool {
+	return len(data) > datagramHeader && data[4] == DatagramFrame
+}
+
+// datagramInput queues a datagram for ReceiveDatagram, the lock must be held
+func (session *UDPMakeSession) datagramInput(data []byte) {
+	if binary.LittleEndian.Uint32(data) != uint32(session.id) {
+		return
+	}
+	d := session.getDatagrams()
+	var b []byte
+	if d.aead != nil {
+		ns := d.aead.NonceSize()
+		if len(data) < datagramHeader+ns {
+			return
+		}
+		var err error
+		b, err = d.aead.Open(nil, data[datagramHeader:datagramHeader+ns], data[datagramHeader+ns:], data[:datagramHeader])
+		if err != nil {
+			return
+		}
+	} else {
+		b = make([]byte, len(data)-datagramHeader)
+		copy(b, data[datagramHeader:])
+	}
+	if len(d.queue) >= datagramQueueLimit {
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+	}
+	d.queue = append(d.queue, b)
+	broadcast(&d.wake, d.waiting)
+}
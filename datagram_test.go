@@ -0,0 +1,54 @@
+package ukcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatagram(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	key := []byte("0123456789abcdef")
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		session := conn.(*UDPMakeSession)
+		session.SetDatagramKey(key)
+		for {
+			b, err := session.ReceiveDatagram()
+			if err != nil {
+				return
+			}
+			session.SendDatagram(b)
+		}
+	}()
+	session, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.SetDatagramKey(key)
+	if err := session.SendDatagram(make([]byte, session.MaxDatagramSize()+1)); err != errDatagramTooLarge {
+		t.Error("oversized datagram", err)
+	}
+	//the server may not have its key yet, datagrams are allowed to get lost
+	for i := 0; ; i++ {
+		session.SendDatagram([]byte("position"))
+		session.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		b, err := session.ReceiveDatagram()
+		if err == nil {
+			if string(b) != "position" {
+				t.Error("bad datagram", string(b))
+			}
+			break
+		}
+		if i > 30 {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package ukcp
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+// per session target published in the README
+const targetSessionBytes = 8 * 1024
+
+func TestSessionFootprint(t *testing.T) {
+	counts := []int{10000, 100000}
+	if testing.Short() {
+		counts = counts[:1]
+	}
+	for _, count := range counts {
+		sessionFootprint(t, count)
+	}
+}
+
+func sessionFootprint(t *testing.T, count int) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sh := l.shards[0]
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+	buf := make([]byte, 5)
+	for i := 0; i < count; i++ {
+		from := &net.UDPAddr{IP: net.IPv4(127, byte(1+i>>16), byte(i>>8), byte(i)), Port: 9}
+		sh.dispatch(makeEncode(buf, FirstSYN, 30+(mainV<<24)+(subV<<16)), from)
+		sh.lock.Lock()
+		id := sh.addrs[from.String()].id
+		sh.lock.Unlock()
+		sh.dispatch(makeEncode(buf, SndSYN, id), from)
+		if _, err := l.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error("sessions started goroutines", count, goroutines, n)
+	}
+	perSession := (after.HeapAlloc - before.HeapAlloc) / uint64(count)
+	t.Log("sessions", count, "bytes per session", perSession)
+	if perSession > targetSessionBytes {
+		t.Error("session footprint over target", count, perSession)
+	}
+}
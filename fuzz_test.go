@@ -0,0 +1,151 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+func FuzzMakeDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(makeEncode(make([]byte, 5), FirstSYN, 0x00060001))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		status, arg := makeDecode(data)
+		if len(data) < 5 {
+			if status != Reset || arg != 0 {
+				t.Error("short data decoded", status, arg)
+			}
+			return
+		}
+		if b := makeEncode(make([]byte, 5), status, int(arg)); string(b) != string(data[:5]) {
+			t.Error("round trip", b, data[:5])
+		}
+	})
+}
+
+// a listener whose shard takes datagrams straight from the fuzzer, the
+// answers go to an address nobody reads
+type fuzzPeer struct {
+	l    *Listener
+	sh   *listenShard
+	from *net.UDPAddr
+}
+
+func newFuzzPeer(f *testing.F) *fuzzPeer {
+	log.SetOutput(io.Discard)
+	f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { l.Close() })
+	return &fuzzPeer{l: l, sh: l.shards[0], from: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+}
+
+func (p *fuzzPeer) session(from *net.UDPAddr) *UDPMakeSession {
+	p.sh.lock.Lock()
+	defer p.sh.lock.Unlock()
+	return p.sh.addrs[from.String()]
+}
+
+// reset drops what the last run left so the next starts from scratch,
+// the accept backlog included
+func (p *fuzzPeer) reset() {
+	for len(p.l.connChan) > 0 {
+		<-p.l.connChan
+	}
+	p.l.lock.Lock()
+	sessions := make([]*UDPMakeSession, 0, len(p.l.sessions))
+	for _, s := range p.l.sessions {
+		sessions = append(sessions, s)
+	}
+	p.l.lock.Unlock()
+	for _, s := range sessions {
+		s.closeOverLocked()
+	}
+}
+
+func fuzzFirstSYN() []byte {
+	maxV := maxVersion
+	syn := make([]byte, 7, 32)
+	makeEncode(syn, FirstSYN, 10+int(maxV.Main())<<24+int(maxV.Sub())<<16)
+	syn[5], syn[6] = minMainV, minSubV
+	return (&Config{StreamMode: true, NoDelay: &defaultNoDelay}).kcpOptions().encode(syn)
+}
+
+func fuzzSndSYN() []byte {
+	return append(makeEncode(make([]byte, 5), SndSYN, 0), make([]byte, pathSecretSize)...)
+}
+
+// FuzzHandshake drives serverInit through "init" and "firstack" with
+// whatever the dialer might send
+func FuzzHandshake(f *testing.F) {
+	p := newFuzzPeer(f)
+	resume := make([]byte, resumeHeader, 64)
+	makeEncode(resume, Resume, 10+int(maxVersion.Sub())<<16)
+	resume[6] = minSubV
+	binary.LittleEndian.PutUint16(resume[15:], 20)
+	resume = append(resume, make([]byte, 20)...)
+	f.Add(fuzzFirstSYN(), fuzzSndSYN())
+	f.Add(fuzzFirstSYN(), fuzzFirstSYN())
+	f.Add(resume, fuzzSndSYN())
+	f.Add([]byte{FirstSYN, 0, 0, 0, 0}, []byte{SndSYN})
+	f.Fuzz(func(t *testing.T, first, second []byte) {
+		defer p.reset()
+		p.sh.dispatch(first, p.from)
+		p.sh.dispatch(second, p.from)
+		p.sh.dispatch(first, p.from)
+	})
+}
+
+// FuzzPacketPath sends an established session what a peer or anybody else
+// might, from its own address and from another. The conv is the session's,
+// the fuzzer could not guess it
+func FuzzPacketPath(f *testing.F) {
+	p := newFuzzPeer(f)
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7}
+	seg := func(cmd uint32, frg byte, payload ...byte) []byte {
+		b := make([]byte, ikcp.OVERHEAD, int(ikcp.OVERHEAD)+len(payload))
+		b[4], b[5], b[6] = byte(cmd), frg, 128
+		binary.LittleEndian.PutUint32(b[20:], uint32(len(payload)))
+		return append(b, payload...)
+	}
+	f.Add(seg(ikcp.CMD_PUSH, 0, Data, 'h', 'i'))
+	f.Add(seg(ikcp.CMD_PUSH, 0, Ping))
+	f.Add(seg(ikcp.CMD_PUSH, 0, StreamFrame, streamSYN, 1, 0, 0, 0))
+	f.Add(seg(ikcp.CMD_PUSH, 0, Fin))
+	f.Add(seg(ikcp.CMD_PUSH, 1, Data, 'a'))
+	f.Add(seg(ikcp.CMD_SACK, 0, 0, 0, 0, 0, 1, 0, 0, 0))
+	f.Add(seg(ikcp.CMD_WASK, 0))
+	f.Add([]byte{0, 0, 0, 0, DatagramFrame, 1, 2, 3})
+	f.Add([]byte{0, 0, 0, 0, PathChallenge, 1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add([]byte{0, 0, 0, 0, PMTUProbe, 0, 0, 0, 0, 11, 0})
+	f.Add([]byte{Reset, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer p.reset()
+		p.sh.dispatch(fuzzFirstSYN(), p.from)
+		p.sh.dispatch(fuzzSndSYN(), p.from)
+		session := p.session(p.from)
+		if session == nil {
+			t.Fatal("no session")
+		}
+		session.lock.Lock()
+		status := session.status
+		session.lock.Unlock()
+		if status != "ok" {
+			t.Fatal("session", status)
+		}
+		data = append([]byte(nil), data...)
+		if _, ok := sessionConv(data); ok {
+			binary.LittleEndian.PutUint32(data, uint32(session.id))
+		}
+		p.sh.dispatch(data, p.from)
+		p.sh.dispatch(data, p.from)
+		p.sh.dispatch(data, other)
+	})
+}
@@ -0,0 +1,98 @@
+package ikcp
+
+// AckPolicy decides when acks leave. The zero value is kcp's own way, the
+// acks of what came in wait for the next flush
+type AckPolicy struct {
+	// NoDelay acks in Input right away, the sender gets the best rtt
+	// samples for a datagram of acks per datagram of data
+	NoDelay bool
+	// Count holds acks back until that many wait, Delay until the oldest
+	// waited that many milliseconds, whichever comes first, the interval
+	// if only Count is set. Fewer acks save upstream, the sender sees the
+	// delay in its rtt and resends later
+	Count uint32
+	Delay uint32
+}
+
+// SetAckPolicy changes when acks leave, acks already waiting follow the new policy
+func (kcp *Ikcpcb) SetAckPolicy(p AckPolicy) {
+	kcp.ackPolicy = p
+}
+
+// Waitack is the number of acks held back
+func (kcp *Ikcpcb) Waitack() int32 {
+	return int32(kcp.ackcount)
+}
+
+func (p *AckPolicy) delayed() bool {
+	return !p.NoDelay && (p.Count > 0 || p.Delay > 0)
+}
+
+func (kcp *Ikcpcb) ackDelay() uint32 {
+	if kcp.ackPolicy.Delay > 0 {
+		return kcp.ackPolicy.Delay
+	}
+	return kcp.interval
+}
+
+// ackDue reports whether the acks waiting should leave with this flush
+func (kcp *Ikcpcb) ackDue() bool {
+	p := &kcp.ackPolicy
+	if kcp.ackcount == 0 {
+		return false
+	}
+	if !p.delayed() || (p.Count > 0 && kcp.ackcount >= p.Count) {
+		return true
+	}
+	return _itimediff(kcp.current, kcp.ackSince) >= int32(kcp.ackDelay())
+}
+
+// ackNow reports whether Input should send the acks without waiting for a flush
+func (kcp *Ikcpcb) ackNow() bool {
+	p := &kcp.ackPolicy
+	return kcp.ackcount > 0 && kcp.updated != 0 &&
+		(p.NoDelay || (p.Count > 0 && kcp.ackcount >= p.Count))
+}
+
+// ackWait is how long until delayed acks are due, -1 with none waiting
+func (kcp *Ikcpcb) ackWait(current uint32) int32 {
+	if kcp.ackcount == 0 || !kcp.ackPolicy.delayed() {
+		return -1
+	}
+	wait := _itimediff(kcp.ackSince+kcp.ackDelay(), current)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// flushAcks puts the waiting acks into the buffer and forgets them
+func (kcp *Ikcpcb) flushAcks(seg *IKCPSEG, buffer, ptr []byte, size int32) ([]byte, int32) {
+	count := int32(kcp.ackcount)
+	if kcp.sack && count > 0 {
+		ptr, size = kcp.flushSack(seg, buffer, ptr, size)
+		seg.cmd = CMD_ACK
+		count = 0
+	}
+	for i := int32(0); i < count; i++ {
+		if size > int32(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+			size = 0
+		}
+		kcp.ackGet(i, &seg.sn, &seg.ts)
+		ptr = encodeSeg(ptr, seg)
+		size += 24
+	}
+	kcp.ackcount = 0
+	seg.sn = 0
+	seg.ts = 0
+	return ptr, size
+}
+
+// sendAcks puts the waiting acks out alone, between flushes
+func (kcp *Ikcpcb) sendAcks() {
+	seg := IKCPSEG{conv: kcp.conv, cmd: CMD_ACK, wnd: uint32(kcp.wndUnused()), una: kcp.rcvNxt}
+	_, size := kcp.flushAcks(&seg, kcp.buffer, kcp.buffer, 0)
+	kcp.output(kcp.buffer, size)
+}
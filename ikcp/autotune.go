@@ -0,0 +1,115 @@
+package ikcp
+
+import "sync/atomic"
+
+// receive window autotuning in the way of Linux TCP's dynamic right sizing:
+// once per rtt the window becomes twice what the application read during
+// it, so only a slow reader holds the sender back. It grows up to a cap and,
+// while the RcvMemory it shares with other kcp is over its limit, gives back
+// half of what it grew each rtt
+type rcvTuner struct {
+	min, max uint32 // segments, min is the window it started from
+	mem      *RcvMemory
+	held     int64  // bytes charged to mem
+	start    uint32 // beginning of the measurement
+	copied   uint32 // segments the application read since
+	space    uint32 // most it read in one rtt so far
+}
+
+// the window covers this many segments more than twice the reads,
+// for the rtt to vary
+const tuneSlack = 16
+
+// RcvMemory counts what the receive buffers of several kcp hold, it is
+// safe to share between goroutines
+type RcvMemory struct {
+	limit int64
+	used  int64
+}
+
+// NewRcvMemory makes a pool of limit bytes
+func NewRcvMemory(limit int) *RcvMemory {
+	return &RcvMemory{limit: int64(limit)}
+}
+
+// Used is what the kcp sharing the pool hold in bytes, counted in segments of mss
+func (m *RcvMemory) Used() int {
+	return int(atomic.LoadInt64(&m.used))
+}
+
+// Pressure reports whether the pool is over its limit
+func (m *RcvMemory) Pressure() bool {
+	return atomic.LoadInt64(&m.used) > m.limit
+}
+
+// SetAutoTune lets the receive window grow from where Wndsize put it up to
+// maxWnd segments, charging what is buffered to mem if not nil. A maxWnd
+// not above the window turns it off, the window goes back to where it was
+// and mem gets back what was charged
+func (kcp *Ikcpcb) SetAutoTune(maxWnd int32, mem *RcvMemory) {
+	if maxWnd > 0xffff {
+		maxWnd = 0xffff
+	}
+	t := kcp.tuner
+	if t != nil && (maxWnd <= int32(t.min) || t.mem != mem) {
+		kcp.rcvWnd = t.min
+		if t.mem != nil {
+			atomic.AddInt64(&t.mem.used, -t.held)
+		}
+		kcp.tuner = nil
+		t = nil
+	}
+	if maxWnd <= int32(kcp.rcvWnd) {
+		return
+	}
+	if t == nil {
+		t = &rcvTuner{min: kcp.rcvWnd, mem: mem, start: kcp.current}
+		kcp.tuner = t
+	}
+	t.max = uint32(maxWnd)
+	if kcp.rcvWnd > t.max {
+		kcp.rcvWnd = t.max
+	}
+}
+
+// RcvWnd is the receive window in segments, autotuning moves it
+func (kcp *Ikcpcb) RcvWnd() int32 {
+	return int32(kcp.rcvWnd)
+}
+
+// autoTune charges what is buffered and, once an rtt has passed, moves the
+// window, Flush calls it before telling the peer
+func (kcp *Ikcpcb) autoTune() {
+	t := kcp.tuner
+	held := int64(kcp.nrcvBuf+kcp.nrcvQue) * int64(kcp.mss)
+	if t.mem != nil && held != t.held {
+		atomic.AddInt64(&t.mem.used, held-t.held)
+	}
+	t.held = held
+	// a receiver that sends nothing has no rtt, a long guess errs on the big side
+	rtt := kcp.rxSrtt
+	if rtt == 0 {
+		rtt = RTO_DEF
+	} else if rtt < kcp.interval {
+		rtt = kcp.interval
+	}
+	if _itimediff(kcp.current, t.start) < int32(rtt) {
+		return
+	}
+	if t.mem != nil && t.mem.Pressure() {
+		kcp.rcvWnd -= (kcp.rcvWnd - t.min) / 2
+		t.space = 0
+	} else if t.copied > t.space {
+		t.space = t.copied
+		want := 2*t.copied + tuneSlack
+		if want > t.max {
+			want = t.max
+		}
+		if want > kcp.rcvWnd {
+			kcp.rcvWnd = want
+			kcp.probe |= ASK_TELL
+		}
+	}
+	t.start = kcp.current
+	t.copied = 0
+}
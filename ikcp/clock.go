@@ -0,0 +1,37 @@
+package ikcp
+
+import "time"
+
+// Clock is where the users of kcp take the time they pass to Update and
+// Check from, and their timers. Tests swap it for a fake one they move by
+// hand, resends, timeouts and retries then take no wall time
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has passed, on a goroutine of its own
+	// like time.AfterFunc, or on the one moving a fake clock
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is what AfterFunc gives, *time.Timer is one. Stop reports
+// whether it was still pending
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the time of the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Millis is t as the current of Update and Check
+func Millis(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,257 @@
+package ikcp
+
+// CongestionController decides how much data may be in flight,
+// Flush and Input report every ack, loss and send to it
+type CongestionController interface {
+	// OnAck is called at the end of Input when something was acknowledged
+	OnAck(ev *AckEvent)
+	// OnLoss is called by Flush after retransmitting, once for all it resent
+	OnLoss(ev *LossEvent)
+	// OnSend is called for every data segment written out
+	OnSend(now, bytes uint32)
+	// CanSend reports whether one more segment may join the inflight ones
+	CanSend(inflight uint32) bool
+	// PacingRate is the send rate in bytes per second, 0 means no pacing
+	PacingRate() uint32
+}
+
+type AckEvent struct {
+	Acked    uint32 // segments snd_una moved forward
+	Bytes    uint32 // payload bytes acknowledged, selectively or by una
+	Rtt      int32  // last rtt sample of this input, -1 if none
+	Inflight uint32 // segments still unacknowledged
+	RmtWnd   uint32
+	Mss      uint32
+	Interval uint32 // flush interval, acks are delayed up to it
+	Now      uint32
+}
+
+type LossEvent struct {
+	Fast     bool   // fast acks had segments resent
+	Timeout  bool   // rto expired for segments, after Fast when both
+	Inflight uint32 // segments unacknowledged
+	Window   uint32 // min of send and remote window
+	Resent   uint32 // fast resend threshold
+	Mss      uint32
+}
+
+// the classic kcp behavior: slow start, congestion avoidance and halving
+type renoController struct {
+	cwnd, ssthresh, incr uint32
+}
+
+func NewRenoController() CongestionController {
+	return &renoController{cwnd: 1, ssthresh: THRESH_INIT}
+}
+
+func (r *renoController) OnAck(ev *AckEvent) {
+	if ev.Acked == 0 || r.cwnd >= ev.RmtWnd {
+		return
+	}
+	mss := ev.Mss
+	if r.cwnd < r.ssthresh {
+		r.cwnd++
+		r.incr += mss
+	} else {
+		if r.incr < mss {
+			r.incr = mss
+		}
+		r.incr += (mss*mss)/r.incr + (mss / 16)
+		if (r.cwnd+1)*mss >= r.incr {
+			r.cwnd++
+		}
+	}
+	if r.cwnd > ev.RmtWnd {
+		r.cwnd = ev.RmtWnd
+		r.incr = ev.RmtWnd * mss
+	}
+}
+
+func (r *renoController) OnLoss(ev *LossEvent) {
+	// a timeout halves the window the flush started with
+	window := _imin_(r.cwnd, ev.Window)
+	if ev.Fast {
+		r.ssthresh = ev.Inflight / 2
+		if r.ssthresh < THRESH_MIN {
+			r.ssthresh = THRESH_MIN
+		}
+		r.cwnd = r.ssthresh + ev.Resent
+		r.incr = r.cwnd * ev.Mss
+	}
+	if ev.Timeout {
+		r.ssthresh = window / 2
+		if r.ssthresh < THRESH_MIN {
+			r.ssthresh = THRESH_MIN
+		}
+		r.cwnd = 1
+		r.incr = ev.Mss
+	}
+	if r.cwnd < 1 {
+		r.cwnd = 1
+		r.incr = ev.Mss
+	}
+}
+
+func (r *renoController) OnSend(now, bytes uint32) {
+}
+
+func (r *renoController) CanSend(inflight uint32) bool {
+	return inflight < r.cwnd
+}
+
+func (r *renoController) PacingRate() uint32 {
+	return 0
+}
+
+// a delay based controller in the spirit of BBR: the window follows the
+// measured bottleneck bandwidth times the min rtt and losses are ignored,
+// for long fat links where loss does not mean congestion
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+)
+
+const (
+	bbrHighGain    = 2.885
+	bbrCwndGain    = 2.0
+	bbrBwWindow    = 10    // rounds kept in the max bandwidth filter
+	bbrMinRttWnd   = 10000 // ms before min rtt is forgotten
+	bbrInitCwnd    = 10
+	bbrMinCwnd     = 4
+	bbrFullBwRatio = 1.25
+	bbrFullBwCount = 3
+)
+
+var bbrCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrController struct {
+	mode           int
+	mss            uint32
+	delivered      uint64
+	roundStart     uint32
+	roundDelivered uint64
+	started        bool
+	bwSamples      [bbrBwWindow]float64 // bytes per ms
+	bwIdx          int
+	btlBw          float64
+	fullBw         float64
+	fullBwCount    int
+	minRtt         uint32
+	minRttStamp    uint32
+	interval       uint32
+	cycleIdx       int
+	pacingGain     float64
+	cwndGain       float64
+	inflight       uint32
+}
+
+func NewBBRController() CongestionController {
+	return &bbrController{mode: bbrStartup, pacingGain: bbrHighGain, cwndGain: bbrHighGain}
+}
+
+func (b *bbrController) OnAck(ev *AckEvent) {
+	b.mss = ev.Mss
+	b.interval = ev.Interval
+	b.inflight = ev.Inflight
+	b.delivered += uint64(ev.Bytes)
+	if ev.Rtt >= 0 {
+		rtt := uint32(ev.Rtt)
+		if rtt < 1 {
+			rtt = 1
+		}
+		if b.minRtt == 0 || rtt <= b.minRtt || _itimediff(ev.Now, b.minRttStamp) > int32(bbrMinRttWnd) {
+			b.minRtt = rtt
+			b.minRttStamp = ev.Now
+		}
+	}
+	if !b.started {
+		b.started = true
+		b.roundStart = ev.Now
+		b.roundDelivered = b.delivered
+		return
+	}
+	// one delivery rate sample per round trip
+	elapsed := _itimediff(ev.Now, b.roundStart)
+	if b.minRtt == 0 || elapsed < int32(b.rtt()) {
+		return
+	}
+	b.bwSamples[b.bwIdx] = float64(b.delivered-b.roundDelivered) / float64(elapsed)
+	b.bwIdx = (b.bwIdx + 1) % bbrBwWindow
+	b.roundStart = ev.Now
+	b.roundDelivered = b.delivered
+	b.btlBw = 0
+	for _, bw := range b.bwSamples {
+		if bw > b.btlBw {
+			b.btlBw = bw
+		}
+	}
+	b.nextRound()
+}
+
+func (b *bbrController) nextRound() {
+	switch b.mode {
+	case bbrStartup:
+		if b.btlBw >= b.fullBw*bbrFullBwRatio {
+			b.fullBw = b.btlBw
+			b.fullBwCount = 0
+			return
+		}
+		b.fullBwCount++
+		if b.fullBwCount >= bbrFullBwCount {
+			b.mode = bbrDrain
+			b.pacingGain = 1 / bbrHighGain
+			b.cwndGain = bbrHighGain
+		}
+	case bbrDrain:
+		if b.inflight <= b.bdp() {
+			b.mode = bbrProbeBW
+			b.cycleIdx = 0
+			b.pacingGain = bbrCycle[0]
+			b.cwndGain = bbrCwndGain
+		}
+	case bbrProbeBW:
+		b.cycleIdx = (b.cycleIdx + 1) % len(bbrCycle)
+		b.pacingGain = bbrCycle[b.cycleIdx]
+	}
+}
+
+// the round trip the window has to cover, acks wait for the next flush
+func (b *bbrController) rtt() uint32 {
+	return b.minRtt + b.interval
+}
+
+// bdp in segments
+func (b *bbrController) bdp() uint32 {
+	if b.mss == 0 {
+		return 0
+	}
+	return uint32(b.btlBw * float64(b.rtt()) / float64(b.mss))
+}
+
+func (b *bbrController) OnLoss(ev *LossEvent) {
+	b.mss = ev.Mss
+}
+
+func (b *bbrController) OnSend(now, bytes uint32) {
+	if !b.started {
+		b.started = true
+		b.roundStart = now
+		b.roundDelivered = b.delivered
+	}
+}
+
+func (b *bbrController) CanSend(inflight uint32) bool {
+	if b.btlBw == 0 {
+		return inflight < bbrInitCwnd
+	}
+	cwnd := uint32(b.cwndGain * float64(b.bdp()))
+	if cwnd < bbrMinCwnd {
+		cwnd = bbrMinCwnd
+	}
+	return inflight < cwnd
+}
+
+func (b *bbrController) PacingRate() uint32 {
+	return uint32(b.pacingGain * b.btlBw * 1000)
+}
@@ -0,0 +1,51 @@
+package ikcp
+
+import "testing"
+
+// FuzzInput feeds untrusted datagrams to a kcp with segments in flight and
+// drains whatever it makes of them
+func FuzzInput(f *testing.F) {
+	//real traffic of both kinds of acks as seeds
+	for _, sack := range []bool{false, true} {
+		l := newLink(func(n int) bool { return n%3 == 0 })
+		l.a.SetSack(sack)
+		l.b.SetSack(sack)
+		l.b.Wndsize(0, 4)
+		msg := make([]byte, 3000)
+		l.a.Send(msg, len(msg))
+		l.a.Send(msg[:10], 10)
+		var seeds [][]byte
+		for i := 0; i < 50; i++ {
+			l.now += 10
+			l.a.Update(l.now)
+			l.b.Update(l.now)
+			seeds = append(seeds, l.toA...)
+			seeds = append(seeds, l.toB...)
+			for _, d := range l.toB {
+				l.b.Input(d, len(d))
+			}
+			for _, d := range l.toA {
+				l.a.Input(d, len(d))
+			}
+			l.toA, l.toB = nil, nil
+		}
+		for _, d := range seeds {
+			f.Add(d)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		kcp := Create(1, nil)
+		kcp.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 { return 0 }
+		kcp.SetSack(true)
+		msg := make([]byte, 5000)
+		kcp.Send(msg, len(msg))
+		kcp.Update(100)
+		//a size beyond the data must not be trusted either
+		kcp.Input(data, len(data)+8)
+		kcp.Input(data, len(data))
+		kcp.Update(200)
+		buf := make([]byte, len(data)+1)
+		for kcp.Recv(buf, int32(len(buf))) > 0 {
+		}
+	})
+}
@@ -34,6 +34,7 @@ const (
 	INTERVAL    uint32 = 100
 	OVERHEAD    uint32 = 24
 	DEADLINK    uint32 = 10
+	STATE_DEAD  uint32 = 0xffffffff // state: a segment went out deadLink times unacked
 	THRESH_INIT uint32 = 2
 	THRESH_MIN  uint32 = 2
 	PROBE_INIT  uint32 = 7000   // 7 secs to probe window size
@@ -163,8 +164,8 @@ func Create(conv uint32, user interface{}) *Ikcpcb {
 		rxMinrto: RTO_MIN,
 		interval: INTERVAL,
 		ts_flush: INTERVAL,
-		ssthresh: THRESH_INIT,
 		deadLink: DEADLINK,
+		cc:       NewRenoController(),
 		buffer:   make([]byte, (MTU_DEF+OVERHEAD)*3),
 	}
 
@@ -174,15 +175,15 @@ func Create(conv uint32, user interface{}) *Ikcpcb {
 type Ikcpcb struct {
 	conv, mtu, mss, state               uint32
 	sndUna, sndNxt, rcvNxt              uint32
-	tsRecent, tsLastack, ssthresh       uint32
+	tsRecent, tsLastack                 uint32
 	rxRttval, rxSrtt, rxRto, rxMinrto   uint32
-	sndWnd, rcvWnd, rmtWnd, cwnd, probe uint32
+	sndWnd, rcvWnd, rmtWnd, probe       uint32
 	current, interval, ts_flush, xmit   uint32
 	nrcvBuf, nsndBuf                    uint32
 	nrcvQue, nsndQue                    uint32
 	nodelay, updated                    uint32
 	tsProbe, probeWait                  uint32
-	deadLink, incr                      uint32
+	deadLink                            uint32
 	sndQueue, rcvQueue, sndBuf, rcvBuf  *list.List
 	acklist                             []uint32
 	ackcount                            uint32
@@ -193,6 +194,16 @@ type Ikcpcb struct {
 	nocwnd                              int32
 	logmask                             int32
 	writelog                            func(log []byte, kcp *Ikcpcb, user []byte)
+	cc                                  CongestionController
+	pacer                               *pacer
+	sack                                bool
+	stream                              bool
+	tuner                               *rcvTuner
+	rtoPolicy                           RtoPolicy
+	ackPolicy                           AckPolicy
+	ackSince                            uint32 // when the oldest waiting ack came
+	sndMid                              bool   // the last segment sent is not the end of its message
+	sackSns, sackList                   []uint32
 
 	Output func(buf []byte, _len int32, kcp *Ikcpcb, user interface{}) int32
 }
@@ -209,6 +220,14 @@ func (kcp *Ikcpcb) output(data []byte, size int32) int32 {
 	if size == 0 {
 		return 0
 	}
+	if kcp.pacer != nil {
+		//the buffer is reused by Flush, keep a copy until the bucket lets it go
+		b := make([]byte, size)
+		copy(b, data[:size])
+		kcp.pacer.queue = append(kcp.pacer.queue, b)
+		kcp.pace(kcp.current)
+		return 0
+	}
 	return kcp.Output(data, size, kcp, kcp.user)
 }
 
@@ -281,6 +300,9 @@ func (kcp *Ikcpcb) Recv(buffer []byte, _len int32) int32 {
 			kcp.rcvQueue.Remove(p)
 			p = q
 			kcp.nrcvQue--
+			if kcp.tuner != nil {
+				kcp.tuner.copied++
+			}
 			//if kcp.user[0] == 0 {
 			//fmt.Println("remove from recvqueue", kcp.rcv_queue.Len(), kcp.user, "rcv q:", kcp.nrcv_que)
 			//}
@@ -358,13 +380,37 @@ func (kcp *Ikcpcb) Send(buffer []byte, _len int) int {
 		return -1
 	}
 
+	// append to the last segment still waiting in stream mode
+	if kcp.stream && kcp.sndQueue.Len() > 0 {
+		old := kcp.sndQueue.Back().Value.(*IKCPSEG)
+		if old._len < kcp.mss {
+			extend := int(kcp.mss - old._len)
+			if _len < extend {
+				extend = _len
+			}
+			if buffer != nil {
+				old.data = append(old.data[:old._len], buffer[:extend]...)
+				buffer = buffer[extend:]
+			} else {
+				old.data = append(old.data[:old._len], make([]byte, extend)...)
+			}
+			old._len += uint32(extend)
+			old.frg = 0
+			_len -= extend
+		}
+		if _len == 0 {
+			return 0
+		}
+	}
+
 	if _len <= int(kcp.mss) {
 		count = 1
 	} else {
 		count = (int32(_len) + int32(kcp.mss) - 1) / int32(kcp.mss)
 	}
 
-	if count > 255 {
+	// in stream mode there are no messages to reassemble, so no limit
+	if count > 255 && !kcp.stream {
 		return -2
 	}
 
@@ -387,6 +433,9 @@ func (kcp *Ikcpcb) Send(buffer []byte, _len int) int {
 		}
 		seg._len = uint32(size)
 		seg.frg = uint32(count - i - 1)
+		if kcp.stream {
+			seg.frg = 0
+		}
 		kcp.sndQueue.PushBack(seg)
 		//if kcp.user[0] == 0 {
 		//fmt.Println(kcp.user, "send", kcp.snd_queue.Len())
@@ -419,7 +468,7 @@ func (kcp *Ikcpcb) UpdateAck(rtt int32) {
 		}
 	}
 	rto = int(kcp.rxSrtt + _imax_(1, 4*kcp.rxRttval))
-	kcp.rxRto = _ibound_(kcp.rxMinrto, uint32(rto), RTO_MAX)
+	kcp.rxRto = _ibound_(kcp.rxMinrto, uint32(rto), kcp.maxRto())
 }
 
 func (kcp *Ikcpcb) shrinkBuf() {
@@ -438,10 +487,11 @@ func (kcp *Ikcpcb) shrinkBuf() {
 	}
 }
 
-func (kcp *Ikcpcb) parseAck(sn uint32) {
+// parseAck returns the payload bytes it acknowledged
+func (kcp *Ikcpcb) parseAck(sn uint32) uint32 {
 	if _itimediff(sn, kcp.sndUna) < 0 || _itimediff(sn, kcp.sndNxt) >= 0 {
 		//fmt.Printf("wi %d,%d  %d,%d\n", sn, kcp.snd_una, sn, kcp.snd_nxt)
-		return
+		return 0
 	}
 
 	for p := kcp.sndBuf.Front(); p != nil; p = p.Next() {
@@ -450,14 +500,17 @@ func (kcp *Ikcpcb) parseAck(sn uint32) {
 			//println("!!!!!!!")
 			kcp.sndBuf.Remove(p)
 			kcp.nsndBuf--
-			break
+			return seg._len
 		} else {
 			seg.fastack++
 		}
 	}
+	return 0
 }
 
-func (kcp *Ikcpcb) parseUna(una uint32) {
+// parseUna returns the payload bytes it acknowledged
+func (kcp *Ikcpcb) parseUna(una uint32) uint32 {
+	var bytes uint32
 	for p := kcp.sndBuf.Front(); p != nil; {
 		seg := p.Value.(*IKCPSEG)
 		if _itimediff(una, seg.sn) > 0 {
@@ -465,10 +518,12 @@ func (kcp *Ikcpcb) parseUna(una uint32) {
 			kcp.sndBuf.Remove(p)
 			p = q
 			kcp.nsndBuf--
+			bytes += seg._len
 		} else {
 			break
 		}
 	}
+	return bytes
 }
 
 // ack append
@@ -492,6 +547,9 @@ func (kcp *Ikcpcb) ackPush(sn, ts uint32) {
 		kcp.ackblock = uint32(newblock)
 	}
 
+	if kcp.ackcount == 0 {
+		kcp.ackSince = kcp.current
+	}
 	ptr := kcp.acklist[kcp.ackcount*2:]
 	ptr[0] = sn
 	ptr[1] = ts
@@ -567,6 +625,13 @@ func (kcp *Ikcpcb) Input(data []byte, size int) int {
 	if data == nil || size < 24 {
 		return 0
 	}
+	// the datagram is untrusted, never read past what it holds
+	if size > len(data) {
+		size = len(data)
+	}
+
+	var acked uint32
+	rtt := int32(-1)
 
 	for {
 		var ts, sn, _len, una, conv uint32
@@ -598,19 +663,26 @@ func (kcp *Ikcpcb) Input(data []byte, size int) int {
 		}
 
 		if cmd != uint8(CMD_PUSH) && cmd != uint8(CMD_ACK) &&
-			cmd != uint8(CMD_WASK) && cmd != uint8(CMD_WINS) {
+			cmd != uint8(CMD_WASK) && cmd != uint8(CMD_WINS) && cmd != uint8(CMD_SACK) {
 			return -3
 		}
 
+		// a message of more fragments than the window never completes,
+		// it would hold rcv_queue forever
+		if cmd == uint8(CMD_PUSH) && uint32(frg) >= kcp.rcvWnd {
+			return -4
+		}
+
 		kcp.rmtWnd = uint32(wnd)
-		kcp.parseUna(una)
+		acked += kcp.parseUna(una)
 		kcp.shrinkBuf()
 
 		if cmd == uint8(CMD_ACK) {
 			if _itimediff(kcp.current, ts) >= 0 {
-				kcp.UpdateAck(_itimediff(kcp.current, ts))
+				rtt = _itimediff(kcp.current, ts)
+				kcp.UpdateAck(rtt)
 			}
-			kcp.parseAck(sn)
+			acked += kcp.parseAck(sn)
 			kcp.shrinkBuf()
 			//if canlog(kcp, LOG_IN_ACK) != 0 {
 			//	log(kcp, LOG_IN_DATA,
@@ -650,6 +722,16 @@ func (kcp *Ikcpcb) Input(data []byte, size int) int {
 			//if canlog(kcp, LOG_IN_PROBE) != 0 {
 			//	log(kcp, LOG_IN_PROBE, "input probe")
 			//}
+		} else if cmd == uint8(CMD_SACK) {
+			if uint64(_len) < uint64(sn)*8 {
+				return -2
+			}
+			if _itimediff(kcp.current, ts) >= 0 {
+				rtt = _itimediff(kcp.current, ts)
+				kcp.UpdateAck(rtt)
+			}
+			acked += kcp.parseSack(data, sn)
+			kcp.shrinkBuf()
 		} else if cmd == uint8(CMD_WINS) {
 			// do nothing
 			//if canlog(kcp, LOG_IN_WIN) != 0 {
@@ -664,28 +746,26 @@ func (kcp *Ikcpcb) Input(data []byte, size int) int {
 		size -= int(_len)
 	}
 
-	if _itimediff(kcp.sndUna, una) > 0 {
-		if kcp.cwnd < kcp.rmtWnd {
-			mss := kcp.mss
-			if kcp.cwnd < kcp.ssthresh {
-				kcp.cwnd++
-				kcp.incr += mss
-			} else {
-				if kcp.incr < mss {
-					kcp.incr = mss
-				}
-				kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-				if (kcp.cwnd+1)*mss >= kcp.incr {
-					kcp.cwnd++
-				}
-			}
-			if kcp.cwnd > kcp.rmtWnd {
-				kcp.cwnd = kcp.rmtWnd
-				kcp.incr = kcp.rmtWnd * mss
-			}
+	if _itimediff(kcp.sndUna, una) > 0 || acked > 0 {
+		var advanced uint32
+		if _itimediff(kcp.sndUna, una) > 0 {
+			advanced = kcp.sndUna - una
 		}
+		kcp.cc.OnAck(&AckEvent{
+			Acked:    advanced,
+			Bytes:    acked,
+			Rtt:      rtt,
+			Inflight: kcp.sndNxt - kcp.sndUna,
+			RmtWnd:   kcp.rmtWnd,
+			Mss:      kcp.mss,
+			Interval: kcp.interval,
+			Now:      kcp.current,
+		})
 	}
 
+	if kcp.ackNow() {
+		kcp.sendAcks()
+	}
 	return 0
 }
 
@@ -714,7 +794,7 @@ func (kcp *Ikcpcb) Flush() {
 	current := kcp.current
 	buffer := kcp.buffer
 	ptr := buffer
-	var count, size, i int32
+	var size int32
 	var resent, cwnd uint32
 	var rtomin uint32
 	change := 0
@@ -725,6 +805,9 @@ func (kcp *Ikcpcb) Flush() {
 	if kcp.updated == 0 {
 		return
 	}
+	if kcp.tuner != nil {
+		kcp.autoTune()
+	}
 
 	seg.conv = kcp.conv
 	seg.cmd = CMD_ACK
@@ -737,21 +820,10 @@ func (kcp *Ikcpcb) Flush() {
 
 	// flush acknowledges
 	size = 0
-	count = int32(kcp.ackcount)
-	for i = 0; i < count; i++ {
-		//size = int32(ptr - buffer)
-		if size > int32(kcp.mtu) {
-			kcp.output(buffer, size)
-			ptr = buffer
-			size = 0
-		}
-		kcp.ackGet(i, &seg.sn, &seg.ts)
-		ptr = encodeSeg(ptr, &seg)
-		size += 24
+	if kcp.ackDue() {
+		ptr, size = kcp.flushAcks(&seg, buffer, ptr, size)
 	}
 
-	kcp.ackcount = 0
-
 	// probe window size (if remote window size equals zero)
 	if kcp.rmtWnd == 0 {
 		if kcp.probeWait == 0 {
@@ -801,11 +873,8 @@ func (kcp *Ikcpcb) Flush() {
 
 	kcp.probe = 0
 
-	// calculate window size
+	// calculate window size, the congestion controller has the last word
 	cwnd = _imin_(kcp.sndWnd, kcp.rmtWnd)
-	if kcp.nocwnd == 0 {
-		cwnd = _imin_(kcp.cwnd, cwnd)
-	}
 
 	// move data from snd_queue to snd_buf
 	////println("check",kcp.snd_queue.Len())
@@ -820,6 +889,9 @@ func (kcp *Ikcpcb) Flush() {
 			//}
 			break
 		}
+		if kcp.nocwnd == 0 && !kcp.cc.CanSend(kcp.sndNxt-kcp.sndUna) {
+			break
+		}
 		newseg := p.Value.(*IKCPSEG)
 		q := p.Next()
 		kcp.sndQueue.Remove(p)
@@ -830,6 +902,7 @@ func (kcp *Ikcpcb) Flush() {
 		//}
 		kcp.nsndQue--
 		kcp.nsndBuf++
+		kcp.sndMid = newseg.frg != 0
 
 		newseg.conv = kcp.conv
 		newseg.cmd = CMD_PUSH
@@ -870,14 +943,10 @@ func (kcp *Ikcpcb) Flush() {
 			needsend = 1
 			segment.xmit++
 			kcp.xmit++
-			if kcp.nodelay == 0 {
-				segment.rto += kcp.rxRto
-			} else {
-				segment.rto += kcp.rxRto / 2
-			}
+			segment.rto = kcp.backoff(segment.rto)
 			segment.resendts = current + segment.rto
 			lost = 1
-		} else if segment.fastack >= resent {
+		} else if segment.fastack >= resent && kcp.fastResend(segment) {
 			needsend = 1
 			segment.xmit++
 			segment.fastack = 0
@@ -908,9 +977,10 @@ func (kcp *Ikcpcb) Flush() {
 				ptr = ptr[segment._len:]
 				size += int32(segment._len)
 			}
+			kcp.cc.OnSend(current, segment._len)
 
 			if segment.xmit >= kcp.deadLink {
-				kcp.state = 0
+				kcp.state = STATE_DEAD
 			}
 		}
 	}
@@ -921,28 +991,8 @@ func (kcp *Ikcpcb) Flush() {
 	}
 
 	// update ssthresh
-	if change != 0 {
-		inflight := kcp.sndNxt - kcp.sndUna
-		kcp.ssthresh = inflight / 2
-		if kcp.ssthresh < THRESH_MIN {
-			kcp.ssthresh = THRESH_MIN
-		}
-		kcp.cwnd = kcp.ssthresh + resent
-		kcp.incr = kcp.cwnd * kcp.mss
-	}
-
-	if lost != 0 {
-		kcp.ssthresh = cwnd / 2
-		if kcp.ssthresh < THRESH_MIN {
-			kcp.ssthresh = THRESH_MIN
-		}
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
-	}
-
-	if kcp.cwnd < 1 {
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
+	if change != 0 || lost != 0 {
+		kcp.cc.OnLoss(&LossEvent{Fast: change != 0, Timeout: lost != 0, Inflight: kcp.sndNxt - kcp.sndUna, Window: cwnd, Resent: resent, Mss: kcp.mss})
 	}
 }
 
@@ -970,6 +1020,12 @@ func (kcp *Ikcpcb) Update(current uint32) {
 			kcp.ts_flush = kcp.current + kcp.interval
 		}
 		kcp.Flush()
+	} else if kcp.ackPolicy.delayed() && kcp.ackDue() {
+		kcp.sendAcks()
+	}
+
+	if kcp.pacer != nil {
+		kcp.pace(kcp.current)
 	}
 }
 
@@ -993,6 +1049,15 @@ func (kcp *Ikcpcb) Check(current uint32) uint32 {
 
 	tm_flush = int(_itimediff(ts_flush, current))
 
+	// held back datagrams must leave before the next flush
+	if wait := kcp.paceWait(current); wait >= 0 && int(wait) < tm_flush {
+		tm_flush = int(wait)
+	}
+	// and so must delayed acks
+	if wait := kcp.ackWait(current); wait >= 0 && int(wait) < tm_flush {
+		tm_flush = int(wait)
+	}
+
 	for p := kcp.sndBuf.Front(); p != nil; p = p.Next() {
 		seg := p.Value.(*IKCPSEG)
 		diff := _itimediff(seg.resendts, current)
@@ -1023,12 +1088,85 @@ func (kcp *Ikcpcb) Setmtu(mtu int32) int32 {
 	if buffer == nil {
 		return -2
 	}
+	shrunk := uint32(mtu)-OVERHEAD < kcp.mss
 	kcp.mtu = uint32(mtu)
 	kcp.mss = kcp.mtu - OVERHEAD
 	kcp.buffer = buffer
+	if shrunk {
+		kcp.resegment()
+	}
 	return 0
 }
 
+// resegment splits the messages waiting in snd_queue again at the mss,
+// segments already sent keep their size, they hold their sn. So does a
+// message partly sent, the peer counts its fragments by the first one
+func (kcp *Ikcpcb) resegment() {
+	queue := list.New()
+	var msg []*IKCPSEG
+	mid := kcp.sndMid
+	for p := kcp.sndQueue.Front(); p != nil; p = p.Next() {
+		seg := p.Value.(*IKCPSEG)
+		msg = append(msg, seg)
+		if seg.frg != 0 {
+			continue
+		}
+		if mid {
+			for _, seg := range msg {
+				queue.PushBack(seg)
+			}
+			mid = false
+		} else {
+			kcp.split(queue, msg)
+		}
+		msg = msg[:0]
+	}
+	for _, seg := range msg {
+		queue.PushBack(seg)
+	}
+	kcp.sndQueue = queue
+	kcp.nsndQue = uint32(queue.Len())
+}
+
+// split pushes the segments of one message cut at the mss
+func (kcp *Ikcpcb) split(queue *list.List, msg []*IKCPSEG) {
+	total := uint32(0)
+	fits := true
+	for _, seg := range msg {
+		total += seg._len
+		fits = fits && seg._len <= kcp.mss
+	}
+	count := (total + kcp.mss - 1) / kcp.mss
+	if fits || (count > 255 && !kcp.stream) {
+		for _, seg := range msg {
+			queue.PushBack(seg)
+		}
+		return
+	}
+	data := make([]byte, 0, total)
+	for _, seg := range msg {
+		data = append(data, seg.data[:seg._len]...)
+	}
+	for i := uint32(0); i < count; i++ {
+		size := kcp.mss
+		if uint32(len(data)) < size {
+			size = uint32(len(data))
+		}
+		seg := kcp.segmentNew(int32(size))
+		copy(seg.data, data[:size])
+		data = data[size:]
+		seg._len = size
+		if !kcp.stream {
+			seg.frg = count - i - 1
+		}
+		queue.PushBack(seg)
+	}
+}
+
+func (kcp *Ikcpcb) Mtu() int32 {
+	return int32(kcp.mtu)
+}
+
 func (kcp *Ikcpcb) Interval(interval int32) int32 {
 	if interval > 5000 {
 		interval = 5000
@@ -1042,11 +1180,7 @@ func (kcp *Ikcpcb) Interval(interval int32) int32 {
 func (kcp *Ikcpcb) Nodelay(nodelay, interval, resend, nc int32) int32 {
 	if nodelay >= 0 {
 		kcp.nodelay = uint32(nodelay)
-		if nodelay != 0 {
-			kcp.rxMinrto = RTO_NDL
-		} else {
-			kcp.rxMinrto = RTO_MIN
-		}
+		kcp.rxMinrto = kcp.minRto()
 	}
 	if interval >= 0 {
 		if interval > 5000 {
@@ -1077,6 +1211,55 @@ func (kcp *Ikcpcb) Wndsize(sndwnd, rcvwnd int32) int32 {
 	return 0
 }
 
+// State is 0 while the link is alive and STATE_DEAD once a segment was
+// sent deadLink times without an ack, it does not come back from there
+func (kcp *Ikcpcb) State() uint32 {
+	return kcp.state
+}
+
+func (kcp *Ikcpcb) IsDead() bool {
+	return kcp.state == STATE_DEAD
+}
+
+// SetDeadLink sets how many times a segment goes out before the link is
+// taken for dead, DEADLINK if n <= 0
+func (kcp *Ikcpcb) SetDeadLink(n int32) {
+	if n <= 0 {
+		n = int32(DEADLINK)
+	}
+	kcp.deadLink = uint32(n)
+}
+
+// ResetXmit counts every segment waiting for an ack as sent once, the dead
+// link only goes by what is sent from there on
+func (kcp *Ikcpcb) ResetXmit() {
+	for p := kcp.sndBuf.Front(); p != nil; p = p.Next() {
+		if segment := p.Value.(*IKCPSEG); segment.xmit > 1 {
+			segment.xmit = 1
+		}
+	}
+}
+
+// SetStream turns stream mode on: Send fills up the last segment that was
+// not sent yet and Recv hands out one segment at a time, with no message
+// boundaries kept. Both sides need the same mode
+func (kcp *Ikcpcb) SetStream(enable bool) {
+	kcp.stream = enable
+}
+
+// SetCongestionController replaces the controller, nil restores the default one,
+// it is only consulted while nocwnd is off
+func (kcp *Ikcpcb) SetCongestionController(cc CongestionController) {
+	if cc == nil {
+		cc = NewRenoController()
+	}
+	kcp.cc = cc
+}
+
+func (kcp *Ikcpcb) PacingRate() uint32 {
+	return kcp.cc.PacingRate()
+}
+
 func (kcp *Ikcpcb) Waitsnd() int32 {
 	return int32(kcp.nsndBuf + kcp.nsndQue)
 }
@@ -0,0 +1,595 @@
+package ikcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// a pair of kcp wired back to back, drop decides which datagrams get lost
+type link struct {
+	a, b     *Ikcpcb
+	toA, toB [][]byte
+	sentB    int            //bytes b put on the wire
+	cmds     map[uint32]int //segments on the wire by cmd, both ways
+	now      uint32
+}
+
+func (l *link) count(buf []byte) {
+	for len(buf) >= int(OVERHEAD) {
+		l.cmds[uint32(buf[4])]++
+		buf = buf[int(OVERHEAD)+int(binary.LittleEndian.Uint32(buf[20:])):]
+	}
+}
+
+func newLink(drop func(n int) bool) *link {
+	l := &link{cmds: map[uint32]int{}}
+	n := 0
+	l.a = Create(1, nil)
+	l.b = Create(1, nil)
+	l.a.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 {
+		n++
+		l.count(buf[:size])
+		if !drop(n) {
+			l.toB = append(l.toB, append([]byte(nil), buf[:size]...))
+		}
+		return 0
+	}
+	l.b.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 {
+		l.sentB += int(size)
+		l.count(buf[:size])
+		l.toA = append(l.toA, append([]byte(nil), buf[:size]...))
+		return 0
+	}
+	for _, kcp := range []*Ikcpcb{l.a, l.b} {
+		kcp.Wndsize(256, 256)
+		kcp.Nodelay(1, 10, 2, 1)
+	}
+	return l
+}
+
+// step moves the clock 10ms and delivers what is in flight
+func (l *link) step() {
+	l.now += 10
+	l.a.Update(l.now)
+	l.b.Update(l.now)
+	for _, d := range l.toB {
+		l.b.Input(d, len(d))
+	}
+	l.toB = nil
+	for _, d := range l.toA {
+		l.a.Input(d, len(d))
+	}
+	l.toA = nil
+}
+
+func transfer(t *testing.T, sack bool) int {
+	//every 7th datagram from the sender gets lost, holes all the way
+	l := newLink(func(n int) bool { return n%7 == 0 })
+	l.a.SetSack(sack)
+	l.b.SetSack(sack)
+	msg := make([]byte, 1000)
+	var got []byte
+	buf := make([]byte, 2000)
+	for i := 0; i < 300; i++ {
+		msg[0] = byte(i)
+		l.a.Send(msg, len(msg))
+	}
+	for i := 0; i < 2000 && len(got) < 300*len(msg); i++ {
+		l.step()
+		for {
+			n := l.b.Recv(buf, int32(len(buf)))
+			if n <= 0 {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+	}
+	if len(got) != 300*len(msg) {
+		t.Fatal("delivered", len(got))
+	}
+	for i := 0; i < 300; i++ {
+		msg[0] = byte(i)
+		if !bytes.Equal(got[i*1000:(i+1)*1000], msg) {
+			t.Fatal("out of order at", i)
+		}
+	}
+	return l.sentB
+}
+
+func TestSack(t *testing.T) {
+	acks := transfer(t, false)
+	sacks := transfer(t, true)
+	if sacks*2 > acks {
+		t.Error("sack did not cut the ack bytes", sacks, acks)
+	}
+}
+
+func TestSackRanges(t *testing.T) {
+	kcp := Create(1, nil)
+	for _, sn := range []uint32{5, 3, 4, 9, 4, 0xffffffff, 0, 10} {
+		kcp.ackPush(sn, sn)
+	}
+	ranges, ts := kcp.sackRanges()
+	want := []uint32{0xffffffff, 1, 3, 6, 9, 11}
+	if len(ranges) != len(want) {
+		t.Fatal(ranges)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Fatal(ranges)
+		}
+	}
+	if ts != 10 {
+		t.Error("ts", ts)
+	}
+}
+
+func TestSackInput(t *testing.T) {
+	l := newLink(func(n int) bool { return true })
+	msg := []byte("in flight")
+	l.a.Send(msg, len(msg))
+	l.step()
+	//a range count whose length check overflows in 32 bits
+	seg := make([]byte, OVERHEAD)
+	encodeSeg(seg, &IKCPSEG{conv: 1, cmd: CMD_SACK, sn: 1 << 29})
+	if r := l.a.Input(seg, len(seg)); r != -2 {
+		t.Error("overflowing range count", r)
+	}
+	//a size past the datagram
+	encodeSeg(seg, &IKCPSEG{conv: 1, cmd: CMD_SACK, sn: 1, _len: 8})
+	if r := l.a.Input(seg, len(seg)+8); r != -2 {
+		t.Error("size past the data", r)
+	}
+}
+
+func TestStream(t *testing.T) {
+	l := newLink(func(n int) bool { return false })
+	l.a.SetStream(true)
+	l.b.SetStream(true)
+	//small sends share segments, a large one is past the 255 fragments
+	var want []byte
+	for i := 0; i < 100; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 10)
+		l.a.Send(msg, len(msg))
+		want = append(want, msg...)
+	}
+	if n := l.a.sndQueue.Len(); n != 1 {
+		t.Error("small sends took segments", n)
+	}
+	big := make([]byte, 300*int(l.a.mss))
+	for i := range big {
+		big[i] = byte(i / 7)
+	}
+	if r := l.a.Send(big, len(big)); r < 0 {
+		t.Fatal("large send", r)
+	}
+	want = append(want, big...)
+	var got []byte
+	buf := make([]byte, 2000)
+	for i := 0; i < 2000 && len(got) < len(want); i++ {
+		l.step()
+		for {
+			n := l.b.Recv(buf, int32(len(buf)))
+			if n <= 0 {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("stream delivered", len(got), "of", len(want))
+	}
+}
+
+func TestSetmtuResegment(t *testing.T) {
+	l := newLink(func(n int) bool { return false })
+	//two segments go out at a time
+	l.a.Wndsize(2, 256)
+	old := int(l.a.mss)
+	first := bytes.Repeat([]byte{1}, 4*old)
+	second := bytes.Repeat([]byte{2}, 3*old)
+	l.a.Send(first, len(first))
+	l.a.Send(second, len(second))
+	l.step()
+	l.a.Setmtu(600)
+	//the rest of the first message keeps its fragments, the second is cut again
+	var sizes []int
+	for p := l.a.sndQueue.Front(); p != nil; p = p.Next() {
+		sizes = append(sizes, int(p.Value.(*IKCPSEG)._len))
+	}
+	if len(sizes) != 2+8 || sizes[0] != old || sizes[2] != int(l.a.mss) || uint32(len(sizes)) != l.a.nsndQue {
+		t.Fatal("queued", sizes, l.a.nsndQue)
+	}
+	buf := make([]byte, 8*old)
+	for _, want := range [][]byte{first, second} {
+		n := int32(-1)
+		for i := 0; i < 100 && n < 0; i++ {
+			l.step()
+			n = l.b.Recv(buf, int32(len(buf)))
+		}
+		if n < 0 || !bytes.Equal(buf[:n], want) {
+			t.Fatal("received", n, "want", len(want))
+		}
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	l := newLink(func(n int) bool { return true })
+	l.a.SetDeadLink(3)
+	msg := []byte("nobody hears this")
+	l.a.Send(msg, len(msg))
+	for i := 0; i < 500 && !l.a.IsDead(); i++ {
+		l.step()
+	}
+	if !l.a.IsDead() || l.a.State() != STATE_DEAD {
+		t.Fatal("link alive without acks", l.a.State())
+	}
+	if l.b.IsDead() {
+		t.Error("receiver dead")
+	}
+}
+
+func TestRtoPolicy(t *testing.T) {
+	l := newLink(func(n int) bool { return true })
+	l.a.SetRtoPolicy(RtoPolicy{Min: 200, Max: 1000, Backoff: 2})
+	if l.a.Rto() != 200 {
+		t.Fatal("rto outside the bounds", l.a.Rto())
+	}
+	//Nodelay no longer decides the minimum
+	l.a.Nodelay(1, 10, 2, 1)
+	if l.a.rxMinrto != 200 {
+		t.Fatal("min rto", l.a.rxMinrto)
+	}
+	var sent []uint32
+	out := l.a.Output
+	l.a.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 {
+		sent = append(sent, l.now)
+		return out(buf, size, kcp, user)
+	}
+	msg := []byte("nobody hears this")
+	l.a.Send(msg, len(msg))
+	for i := 0; i < 600; i++ {
+		l.step()
+	}
+	if len(sent) < 5 {
+		t.Fatal("sends", sent)
+	}
+	//200ms, then doubling up to the 1000ms cap
+	want := []uint32{0, 200, 400, 800, 1000, 1000}
+	for i := 1; i < len(sent) && i < len(want); i++ {
+		gap := sent[i] - sent[i-1]
+		if gap+10 < want[i] || gap > want[i]+20 {
+			t.Errorf("resend %d after %dms, want %dms", i, gap, want[i])
+		}
+	}
+}
+
+func TestRtoPolicyMax(t *testing.T) {
+	l := newLink(func(n int) bool { return true })
+	//kcp's own backoff stays within Max as well
+	l.a.SetRtoPolicy(RtoPolicy{Min: 200, Max: 500})
+	var sent []uint32
+	out := l.a.Output
+	l.a.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 {
+		sent = append(sent, l.now)
+		return out(buf, size, kcp, user)
+	}
+	msg := []byte("nobody hears this")
+	l.a.Send(msg, len(msg))
+	for i := 0; i < 600; i++ {
+		l.step()
+	}
+	if len(sent) < 10 {
+		t.Fatal("sends", sent)
+	}
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i] - sent[i-1]; gap > 500+20 {
+			t.Errorf("resend %d after %dms", i, gap)
+		}
+	}
+}
+
+func TestFastLimit(t *testing.T) {
+	kcp := Create(1, nil)
+	seg := &IKCPSEG{xmit: 3}
+	if !kcp.fastResend(seg) {
+		t.Error("limited without a limit")
+	}
+	kcp.SetRtoPolicy(RtoPolicy{FastLimit: 3})
+	if kcp.fastResend(seg) {
+		t.Error("fast resend past the limit")
+	}
+	seg.xmit = 2
+	if !kcp.fastResend(seg) {
+		t.Error("fast resend below the limit")
+	}
+}
+
+func TestZeroWindow(t *testing.T) {
+	l := newLink(func(n int) bool { return false })
+	l.b.Wndsize(0, 8)
+	msg := make([]byte, 100)
+	for i := 0; i < 40; i++ {
+		msg[0] = byte(i)
+		l.a.Send(msg, len(msg))
+	}
+	//nobody reads b, its queue fills the window and a stops
+	for i := 0; i < 20; i++ {
+		l.step()
+	}
+	if l.a.rmtWnd != 0 || l.b.nrcvQue != 8 {
+		t.Fatal("window did not close", l.a.rmtWnd, l.b.nrcvQue)
+	}
+	//a asks for the window once probeWait has passed, b tells it is still shut
+	for i := uint32(0); i < PROBE_INIT/10+10; i++ {
+		l.step()
+	}
+	if l.cmds[CMD_WASK] == 0 || l.cmds[CMD_WINS] == 0 || l.a.rmtWnd != 0 {
+		t.Fatal("no probe", l.cmds, l.a.rmtWnd)
+	}
+	//reading what arrived opens the window and b tells a without being asked
+	wins := l.cmds[CMD_WINS]
+	buf := make([]byte, 200)
+	got := 0
+	for l.b.Recv(buf, int32(len(buf))) > 0 {
+		got++
+	}
+	l.step()
+	if l.cmds[CMD_WINS] != wins+1 || l.a.rmtWnd == 0 {
+		t.Fatal("no window update", l.cmds, l.a.rmtWnd)
+	}
+	for i := 0; i < 100 && got < 40; i++ {
+		l.step()
+		for l.b.Recv(buf, int32(len(buf))) > 0 {
+			if buf[0] != byte(got) {
+				t.Fatal("out of order at", got)
+			}
+			got++
+		}
+	}
+	if got != 40 {
+		t.Error("delivered", got)
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	l := newLink(func(n int) bool { return false })
+	l.a.Wndsize(1024, 0)
+	l.b.Wndsize(0, 32)
+	mem := NewRcvMemory(200 * int(l.b.mss))
+	l.b.SetAutoTune(512, mem)
+	msg := make([]byte, 1000)
+	buf := make([]byte, 2000)
+	run := func(steps int, read bool) {
+		for i := 0; i < steps; i++ {
+			for l.a.Waitsnd() < 2000 {
+				l.a.Send(msg, len(msg))
+			}
+			l.step()
+			for read && l.b.Recv(buf, int32(len(buf))) > 0 {
+			}
+		}
+	}
+	//a reader that keeps up opens the window
+	run(200, true)
+	if w := l.b.RcvWnd(); w <= 32 || w > 512 {
+		t.Fatal("window did not grow", w)
+	}
+	if l.a.rmtWnd <= 32 {
+		t.Error("sender not told", l.a.rmtWnd)
+	}
+	//one that stops fills the pool, the window falls back
+	grown := l.b.RcvWnd()
+	run(200, false)
+	if !mem.Pressure() || l.b.RcvWnd() >= grown {
+		t.Error("window did not shrink", mem.Used(), l.b.RcvWnd(), grown)
+	}
+	l.b.SetAutoTune(0, nil)
+	if mem.Used() != 0 || l.b.RcvWnd() != 32 {
+		t.Error("not released", mem.Used(), l.b.RcvWnd())
+	}
+}
+
+func TestAckPolicy(t *testing.T) {
+	send := func(l *link, n int) {
+		for i := 0; i < n; i++ {
+			l.a.Send([]byte{byte(i)}, 1)
+		}
+		l.now += 10
+		l.a.Update(l.now)
+		for _, d := range l.toB {
+			l.b.Input(d, len(d))
+		}
+		l.toB = nil
+	}
+	tick := func(l *link) {
+		l.now += 10
+		l.b.Update(l.now)
+	}
+	//kcp's own way waits for the flush
+	l := newLink(func(n int) bool { return false })
+	tick(l)
+	send(l, 1)
+	if len(l.toA) != 0 {
+		t.Error("acked before the flush")
+	}
+	tick(l)
+	if l.cmds[CMD_ACK] != 1 {
+		t.Error("not acked on the flush", l.cmds)
+	}
+
+	l = newLink(func(n int) bool { return false })
+	l.b.SetAckPolicy(AckPolicy{NoDelay: true})
+	tick(l)
+	send(l, 1)
+	if l.cmds[CMD_ACK] != 1 {
+		t.Error("no delay ack", l.cmds)
+	}
+
+	//coalesced: the fourth segment lets them go, together
+	l = newLink(func(n int) bool { return false })
+	l.b.SetAckPolicy(AckPolicy{Count: 4, Delay: 1000})
+	tick(l)
+	send(l, 3)
+	for i := 0; i < 5; i++ {
+		tick(l)
+	}
+	if l.cmds[CMD_ACK] != 0 || l.b.Waitack() != 3 {
+		t.Fatal("acked before the count", l.cmds, l.b.Waitack())
+	}
+	send(l, 1)
+	if l.cmds[CMD_ACK] != 4 || l.b.Waitack() != 0 {
+		t.Error("not acked at the count", l.cmds)
+	}
+
+	//delayed: the oldest ack waits 30ms, Check knows when
+	l = newLink(func(n int) bool { return false })
+	l.b.SetAckPolicy(AckPolicy{Delay: 30})
+	tick(l)
+	send(l, 1)
+	since := l.b.current //the clock of its last update
+	if next := l.b.Check(l.now); next-since > 30 {
+		t.Error("check past the delay", next-since)
+	}
+	for l.cmds[CMD_ACK] == 0 && l.now-since < 100 {
+		tick(l)
+	}
+	if d := l.now - since; d < 30 || d > 40 {
+		t.Error("acked after", d)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	l := newLink(func(n int) bool { return false })
+	l.a.Wndsize(1024, 1024)
+	l.b.Wndsize(1024, 1024)
+	//1MB/s, updated every 10ms like ukcp does
+	l.a.SetPacing(true, 1000000)
+	msg := make([]byte, 1000)
+	for i := 0; i < 1500; i++ {
+		l.a.Send(msg, len(msg))
+	}
+	sent := 0
+	out := l.a.Output
+	l.a.Output = func(buf []byte, size int32, kcp *Ikcpcb, user interface{}) int32 {
+		sent += int(size)
+		return out(buf, size, kcp, user)
+	}
+	for i := 0; i < 100; i++ {
+		l.step()
+	}
+	if sent < 900000 || sent > 1150000 {
+		t.Error("paced", sent, "bytes in a second")
+	}
+}
+
+func TestRenoController(t *testing.T) {
+	r := NewRenoController().(*renoController)
+	if !r.CanSend(0) || r.CanSend(1) {
+		t.Fatal("initial window", r.cwnd)
+	}
+	ack := &AckEvent{Acked: 1, RmtWnd: 128, Mss: 1000}
+	//slow start up to ssthresh, then the window grows up to the remote one
+	r.OnAck(ack)
+	if r.cwnd != 2 || !r.CanSend(1) || r.CanSend(2) {
+		t.Fatal("slow start", r.cwnd)
+	}
+	ack.RmtWnd = 10
+	for i := 0; i < 100; i++ {
+		r.OnAck(ack)
+	}
+	if r.cwnd != 10 || !r.CanSend(9) || r.CanSend(10) {
+		t.Fatal("congestion avoidance", r.cwnd)
+	}
+	r.cwnd = 20
+	r.OnLoss(&LossEvent{Fast: true, Inflight: 16, Window: 128, Resent: 2, Mss: 1000})
+	if r.ssthresh != 8 || r.cwnd != 10 {
+		t.Error("fast retransmit", r.ssthresh, r.cwnd)
+	}
+	//a timeout in the same flush halves the window the flush started with
+	r.cwnd = 20
+	r.OnLoss(&LossEvent{Fast: true, Timeout: true, Inflight: 16, Window: 128, Resent: 2, Mss: 1000})
+	if r.ssthresh != 10 || r.cwnd != 1 {
+		t.Error("fast retransmit and timeout", r.ssthresh, r.cwnd)
+	}
+	r.cwnd = 20
+	r.OnLoss(&LossEvent{Timeout: true, Inflight: 16, Window: 2, Mss: 1000})
+	if r.ssthresh != THRESH_MIN || r.cwnd != 1 {
+		t.Error("timeout", r.ssthresh, r.cwnd)
+	}
+}
+
+func TestRenoTimeout(t *testing.T) {
+	//everything from the sender is lost for a while, then nothing
+	l := newLink(func(n int) bool { return n > 5 && n <= 40 })
+	l.a.Nodelay(1, 10, 2, 0)
+	r := l.a.cc.(*renoController)
+	msg := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		l.a.Send(msg, len(msg))
+	}
+	collapsed := false
+	got := 0
+	buf := make([]byte, 2000)
+	for i := 0; i < 2000 && got < 100; i++ {
+		l.step()
+		if r.cwnd == 1 {
+			collapsed = true
+		}
+		for l.b.Recv(buf, int32(len(buf))) > 0 {
+			got++
+		}
+	}
+	if !collapsed || got != 100 {
+		t.Error("timeout", collapsed, "delivered", got)
+	}
+	if r.cwnd <= 1 {
+		t.Error("window did not grow back", r.cwnd)
+	}
+}
+
+func TestBBRController(t *testing.T) {
+	b := NewBBRController().(*bbrController)
+	if !b.CanSend(bbrInitCwnd-1) || b.CanSend(bbrInitCwnd) || b.PacingRate() != 0 {
+		t.Fatal("initial window")
+	}
+	now := uint32(0)
+	b.OnSend(now, 1000)
+	//one ack a round, the round is the min rtt plus the flush interval
+	round := func(bytes, inflight uint32) {
+		now += 60
+		b.OnAck(&AckEvent{Acked: 1, Bytes: bytes, Rtt: 50, Inflight: inflight, RmtWnd: 1024, Mss: 1000, Interval: 10, Now: now})
+	}
+	for bytes := uint32(6000); bytes <= 96000; bytes *= 2 {
+		round(bytes, 100)
+	}
+	if b.mode != bbrStartup || b.pacingGain != bbrHighGain {
+		t.Fatal("left startup while growing", b.mode)
+	}
+	//the bandwidth stops growing, startup is over
+	for i := 0; i < bbrFullBwCount; i++ {
+		round(96000, 100)
+	}
+	if b.mode != bbrDrain || float64(b.PacingRate()) >= b.btlBw*1000 {
+		t.Fatal("drain", b.mode, b.PacingRate())
+	}
+	bdp := b.bdp()
+	if bdp != 96 || !b.CanSend(uint32(bbrHighGain*float64(bdp))-1) {
+		t.Error("bdp", bdp)
+	}
+	//losses do not move the window
+	b.OnLoss(&LossEvent{Fast: true, Timeout: true, Inflight: 100, Mss: 1000})
+	if b.mode != bbrDrain || b.bdp() != bdp {
+		t.Error("loss moved the window", b.mode, b.bdp())
+	}
+	//the queue drained below the bdp, probing cycles the gain
+	round(96000, bdp)
+	if b.mode != bbrProbeBW || b.pacingGain != bbrCycle[0] || b.CanSend(uint32(bbrCwndGain*float64(bdp))) {
+		t.Fatal("probe", b.mode, b.pacingGain)
+	}
+	round(96000, bdp)
+	if b.pacingGain != bbrCycle[1] {
+		t.Error("cycle", b.pacingGain)
+	}
+}
@@ -0,0 +1,114 @@
+package ikcp
+
+// token bucket between Flush and Output, datagrams leave at the pacing
+// rate instead of in one burst per flush
+type pacer struct {
+	rate   uint32 // configured bytes per second, 0 follows the estimates
+	tokens int64  // bytes that may leave right now
+	last   uint32
+	queue  [][]byte
+}
+
+// the bucket holds at most this many datagrams or milliseconds worth of
+// tokens, enough for callers that Update every 10ms like ukcp's wheel
+const (
+	paceBurst   = 2
+	paceBurstMs = 10
+)
+
+// SetPacing turns pacing on or off, rate is in bytes per second and 0 means
+// the congestion controller's pacing rate or, failing that, window / srtt
+func (kcp *Ikcpcb) SetPacing(enable bool, rate uint32) {
+	if !enable {
+		if kcp.pacer != nil {
+			for _, b := range kcp.pacer.queue {
+				kcp.Output(b, int32(len(b)), kcp, kcp.user)
+			}
+		}
+		kcp.pacer = nil
+		return
+	}
+	if kcp.pacer == nil {
+		kcp.pacer = &pacer{last: kcp.current}
+	}
+	kcp.pacer.rate = rate
+}
+
+// Waitpace is the number of datagrams held back by pacing
+func (kcp *Ikcpcb) Waitpace() int32 {
+	if kcp.pacer == nil {
+		return 0
+	}
+	return int32(len(kcp.pacer.queue))
+}
+
+func (kcp *Ikcpcb) paceRate() uint32 {
+	p := kcp.pacer
+	if p.rate > 0 {
+		return p.rate
+	}
+	if kcp.nocwnd == 0 {
+		if rate := kcp.cc.PacingRate(); rate > 0 {
+			return rate
+		}
+	}
+	if kcp.rxSrtt == 0 {
+		return 0
+	}
+	// a window per round trip with some headroom, the window is the limit anyway
+	srtt := _imax_(kcp.rxSrtt, kcp.interval)
+	bytes := uint64(_imin_(kcp.sndWnd, kcp.rmtWnd)) * uint64(kcp.mtu)
+	return uint32(bytes * 1000 * 5 / 4 / uint64(srtt))
+}
+
+// pace sends what the bucket allows at current
+func (kcp *Ikcpcb) pace(current uint32) {
+	p := kcp.pacer
+	rate := kcp.paceRate()
+	if rate == 0 {
+		for _, b := range p.queue {
+			kcp.Output(b, int32(len(b)), kcp, kcp.user)
+		}
+		p.queue = p.queue[:0]
+		p.last = current
+		return
+	}
+	elapsed := _itimediff(current, p.last)
+	if elapsed > 0 {
+		p.tokens += int64(rate) * int64(elapsed) / 1000
+		p.last = current
+	}
+	limit := int64(paceBurst * kcp.mtu)
+	if l := int64(rate) * paceBurstMs / 1000; l > limit {
+		limit = l
+	}
+	if p.tokens > limit {
+		p.tokens = limit
+	}
+	n := 0
+	for n < len(p.queue) && p.tokens > 0 {
+		b := p.queue[n]
+		kcp.Output(b, int32(len(b)), kcp, kcp.user)
+		p.tokens -= int64(len(b))
+		n++
+	}
+	p.queue = p.queue[:copy(p.queue, p.queue[n:])]
+}
+
+// paceWait is how long until the next held datagram may leave, -1 if none
+func (kcp *Ikcpcb) paceWait(current uint32) int32 {
+	p := kcp.pacer
+	if p == nil || len(p.queue) == 0 {
+		return -1
+	}
+	rate := kcp.paceRate()
+	if rate == 0 || p.tokens > 0 {
+		return 0
+	}
+	wait := int32((-p.tokens + 1) * 1000 / int64(rate))
+	wait -= _itimediff(current, p.last)
+	if wait < 1 {
+		wait = 1
+	}
+	return wait
+}
@@ -0,0 +1,74 @@
+package ikcp
+
+// RtoPolicy tunes how eagerly segments are resent. The zero value is kcp's
+// own way, Nodelay picks the minimum rto and how it backs off
+type RtoPolicy struct {
+	// Min and Max bound the rto in milliseconds, 0 keeps what Nodelay
+	// picks for Min and RTO_MAX for Max
+	Min uint32
+	Max uint32
+	// Backoff multiplies the rto of a segment each time it times out, up
+	// to Max. 0 adds the current rto instead, half of it with nodelay, also
+	// up to Max
+	Backoff float64
+	// FastLimit stops fast resends of a segment sent that many times,
+	// later resends wait for the rto. 0 means no limit
+	FastLimit uint32
+}
+
+// SetRtoPolicy changes how segments are resent, the rto moves into the new
+// bounds at once, segments in flight back off the new way from their next timeout
+func (kcp *Ikcpcb) SetRtoPolicy(p RtoPolicy) {
+	if p.Max > 0 && p.Min > p.Max {
+		p.Min = p.Max
+	}
+	if p.Backoff > 0 && p.Backoff < 1 {
+		p.Backoff = 1
+	}
+	kcp.rtoPolicy = p
+	kcp.rxMinrto = kcp.minRto()
+	kcp.rxRto = _ibound_(kcp.rxMinrto, kcp.rxRto, kcp.maxRto())
+}
+
+// Rto is the current retransmission timeout in milliseconds
+func (kcp *Ikcpcb) Rto() uint32 {
+	return kcp.rxRto
+}
+
+func (kcp *Ikcpcb) minRto() uint32 {
+	if kcp.rtoPolicy.Min > 0 {
+		return kcp.rtoPolicy.Min
+	}
+	if kcp.nodelay != 0 {
+		return RTO_NDL
+	}
+	return RTO_MIN
+}
+
+func (kcp *Ikcpcb) maxRto() uint32 {
+	if kcp.rtoPolicy.Max > 0 {
+		return kcp.rtoPolicy.Max
+	}
+	return RTO_MAX
+}
+
+// backoff is the rto of a segment after it timed out
+func (kcp *Ikcpcb) backoff(rto uint32) uint32 {
+	if b := kcp.rtoPolicy.Backoff; b > 0 {
+		next := float64(rto) * b
+		if next >= float64(kcp.maxRto()) {
+			return kcp.maxRto()
+		}
+		return uint32(next)
+	}
+	next := rto + kcp.rxRto/2
+	if kcp.nodelay == 0 {
+		next = rto + kcp.rxRto
+	}
+	return _imin_(next, kcp.maxRto())
+}
+
+// fastResend reports whether a segment may go out again on fast acks
+func (kcp *Ikcpcb) fastResend(seg *IKCPSEG) bool {
+	return kcp.rtoPolicy.FastLimit == 0 || seg.xmit < kcp.rtoPolicy.FastLimit
+}
@@ -0,0 +1,122 @@
+package ikcp
+
+import "sort"
+
+// CMD_SACK acknowledges ranges of sn in one segment where CMD_ACK needs a
+// segment for each: sn holds the number of ranges, ts the newest timestamp
+// among what it acks and the data [first sn][last sn + 1] pairs, ascending.
+// Input of a kcp without it fails with -3, only turn it on when both sides
+// agreed, receiving it works either way
+const CMD_SACK uint32 = 85
+
+// SetSack makes Flush send CMD_SACK instead of one CMD_ACK per segment
+func (kcp *Ikcpcb) SetSack(enable bool) {
+	kcp.sack = enable
+}
+
+// sackRanges sorts the ack list into ranges, ts is the newest timestamp in it
+func (kcp *Ikcpcb) sackRanges() (ranges []uint32, ts uint32) {
+	sns := kcp.sackSns[:0]
+	for i := uint32(0); i < kcp.ackcount; i++ {
+		sn, t := kcp.acklist[i*2], kcp.acklist[i*2+1]
+		if i == 0 || _itimediff(t, ts) > 0 {
+			ts = t
+		}
+		sns = append(sns, sn)
+	}
+	sort.Slice(sns, func(i, j int) bool { return _itimediff(sns[i], sns[j]) < 0 })
+	kcp.sackSns = sns
+	ranges = kcp.sackList[:0]
+	for i, sn := range sns {
+		if i > 0 && sn == sns[i-1] {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1] == sn {
+			ranges[n-1]++
+		} else {
+			ranges = append(ranges, sn, sn+1)
+		}
+	}
+	kcp.sackList = ranges
+	return
+}
+
+// flushSack puts the ack list into the buffer as CMD_SACK segments
+func (kcp *Ikcpcb) flushSack(seg *IKCPSEG, buffer, ptr []byte, size int32) ([]byte, int32) {
+	ranges, ts := kcp.sackRanges()
+	seg.cmd = CMD_SACK
+	seg.ts = ts
+	max := int(kcp.mss / 8)
+	for len(ranges) > 0 {
+		n := len(ranges) / 2
+		if n > max {
+			n = max
+		}
+		seg.sn = uint32(n)
+		seg._len = uint32(n * 8)
+		if size+int32(OVERHEAD+seg._len) > int32(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
+			size = 0
+		}
+		ptr = encodeSeg(ptr, seg)
+		for _, sn := range ranges[:n*2] {
+			ptr = encode32u(ptr, sn)
+		}
+		size += int32(OVERHEAD + seg._len)
+		ranges = ranges[n*2:]
+	}
+	seg._len = 0
+	seg.sn = 0
+	seg.ts = 0
+	return ptr, size
+}
+
+// parseSack drops what the ranges cover from snd_buf and counts the
+// segments they jump over for fast resend, as many CMD_ACK would. It
+// returns the payload bytes it acknowledged
+func (kcp *Ikcpcb) parseSack(data []byte, n uint32) uint32 {
+	// first count what gets acked, a hole is passed by what lies above it
+	var total uint32
+	i := uint32(0)
+	for p := kcp.sndBuf.Front(); p != nil && i < n; p = p.Next() {
+		sn := p.Value.(*IKCPSEG).sn
+		for i < n && _itimediff(sn, sackEnd(data, i)) >= 0 {
+			i++
+		}
+		if i < n && _itimediff(sn, sackStart(data, i)) >= 0 {
+			total++
+		}
+	}
+	var bytes, seen uint32
+	i = 0
+	for p := kcp.sndBuf.Front(); p != nil && seen < total; {
+		seg := p.Value.(*IKCPSEG)
+		for i < n && _itimediff(seg.sn, sackEnd(data, i)) >= 0 {
+			i++
+		}
+		q := p.Next()
+		if i < n && _itimediff(seg.sn, sackStart(data, i)) >= 0 {
+			kcp.sndBuf.Remove(p)
+			kcp.nsndBuf--
+			bytes += seg._len
+			seen++
+		} else {
+			seg.fastack += total - seen
+		}
+		p = q
+	}
+	return bytes
+}
+
+func sackStart(data []byte, i uint32) uint32 {
+	var sn uint32
+	decode32u(data[i*8:], &sn)
+	return sn
+}
+
+func sackEnd(data []byte, i uint32) uint32 {
+	var sn uint32
+	decode32u(data[i*8+4:], &sn)
+	return sn
+}
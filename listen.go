@@ -0,0 +1,171 @@
+package ukcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+type ListenConfig struct {
+	Config
+	// Shards is the number of sockets opened on the address with SO_REUSEPORT,
+	// each one gets its own read loop and session table, the kernel hashes
+	// the 4-tuple so a client always lands on the same shard.
+	// 0 or 1 means a single plain socket.
+	Shards int
+	// RcvMemory caps in bytes what the autotuned sessions of the listener
+	// hold unread together, past it their windows shrink back towards
+	// RcvWnd. 0 means no cap beyond each session's RcvBufMax
+	RcvMemory int
+}
+
+func (lc *ListenConfig) Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := lc.Shards
+	if n < 1 {
+		n = 1
+	}
+	socks := make([]net.PacketConn, 0, n)
+	if n == 1 {
+		sock, _err := net.ListenUDP("udp", udpAddr)
+		if _err != nil {
+			return nil, _err
+		}
+		socks = append(socks, sock)
+	} else {
+		nlc := net.ListenConfig{Control: reusePortControl}
+		bind := udpAddr.String()
+		for i := 0; i < n; i++ {
+			conn, _err := nlc.ListenPacket(context.Background(), "udp", bind)
+			if _err != nil {
+				for _, sock := range socks {
+					sock.Close()
+				}
+				return nil, _err
+			}
+			//the first socket picks the port when addr asks for any
+			bind = conn.LocalAddr().String()
+			socks = append(socks, conn)
+		}
+	}
+	return lc.serve(socks)
+}
+
+// ListenPacket serves sessions over conn instead of sockets of its own, as
+// over the in-memory network of ukcptest, Shards does not apply. The
+// listener owns conn from then on, Close closes it
+func (lc *ListenConfig) ListenPacket(conn net.PacketConn) (*Listener, error) {
+	return lc.serve([]net.PacketConn{conn})
+}
+
+// serve makes a listener with a shard for each of socks
+func (lc *ListenConfig) serve(socks []net.PacketConn) (*Listener, error) {
+	ticketKey := lc.TicketKey
+	if ticketKey == nil {
+		ticketKey = newTicketKey()
+	}
+	ticketAEAD, err := newAEAD(ticketKey)
+	if err != nil {
+		for _, sock := range socks {
+			sock.Close()
+		}
+		return nil, err
+	}
+	listener := &Listener{connChan: make(chan *UDPMakeSession, acceptBacklog), quitChan: make(chan bool), wheel: newTimerWheel(lc.clock()), sessions: make(map[uint32]*UDPMakeSession), config: lc.Config, ticketAEAD: ticketAEAD}
+	if lc.RcvMemory > 0 {
+		listener.rcvMemory = ikcp.NewRcvMemory(lc.RcvMemory)
+	}
+	for _, sock := range socks {
+		listener.shards = append(listener.shards, &listenShard{listener: listener, sock: sock, readBuffer: make([]byte, ReadBufferSize), addrs: make(map[string]*UDPMakeSession)})
+	}
+	go listener.loop()
+	return listener, nil
+}
+
+// ShutdownSummary tells what Shutdown could not close cleanly
+type ShutdownSummary struct {
+	Drained      int        //sessions that flushed and finished the close handshake
+	Aborted      int        //sessions reset when the context expired, or still shaking hands
+	Unsent       int        //kcp segments the aborted sessions did not get acked
+	AbortedAddrs []net.Addr //remote addresses of the aborted sessions
+}
+
+func (l *Listener) isShutting() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.shutting
+}
+
+// Shutdown refuses new handshakes, sends Close to every session after what it
+// has queued and waits for the peers to answer, sessions still open when ctx
+// expires are reset. The sockets are closed at the end like Close does, the
+// error is ctx.Err() if anything had to be aborted that way
+func (l *Listener) Shutdown(ctx context.Context) (ShutdownSummary, error) {
+	var summary ShutdownSummary
+	l.lock.Lock()
+	if l.shutting || l.closed {
+		l.lock.Unlock()
+		return summary, nil
+	}
+	l.shutting = true
+	sessions := make([]*UDPMakeSession, 0, len(l.sessions))
+	for _, session := range l.sessions {
+		sessions = append(sessions, session)
+	}
+	l.lock.Unlock()
+
+	for _, session := range sessions {
+		session.lock.Lock()
+		if session.status != "ok" {
+			summary.Aborted++
+			summary.AbortedAddrs = append(summary.AbortedAddrs, session.remote)
+			session.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
+			session.closeOver()
+		} else {
+			session.closeDrain()
+		}
+		session.lock.Unlock()
+	}
+	var err error
+wait:
+	for _, session := range sessions {
+		select {
+		case <-session.quitChan:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+	for _, session := range sessions {
+		session.lock.Lock()
+		if session.isQuit() {
+			if session.status == "ok" {
+				summary.Drained++
+			}
+		} else {
+			summary.Aborted++
+			summary.AbortedAddrs = append(summary.AbortedAddrs, session.remote)
+			summary.Unsent += int(session.kcp.Waitsnd())
+			session.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
+			session.closeOver()
+		}
+		session.lock.Unlock()
+	}
+	l.Close()
+	return summary, err
+}
+
+// closeDrain is closeBegin without the closeWait limit, Shutdown's context
+// decides how long the queued data may take, the lock must be held
+func (session *UDPMakeSession) closeDrain() {
+	if session.closed {
+		//already closing on its own
+		return
+	}
+	session.closed = true
+	session.sendFrame(Close)
+}
@@ -0,0 +1,137 @@
+package ukcp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msg := make([]byte, 1<<20)
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(msg)
+				written <- true
+			}()
+		}
+	}()
+	reader, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	//this one never reads, its window fills up and it cannot drain
+	stuck, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	got := make(chan int)
+	go func() {
+		n := 0
+		buff := make([]byte, dataLimit)
+		for {
+			m, err := reader.Read(buff)
+			n += m
+			if err != nil {
+				got <- n
+				return
+			}
+		}
+	}()
+	<-written
+	<-written
+	//the reader drains in well under a second, but a loaded run can lose the
+	//tail of the burst on loopback and wait out a few backed off resends
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	summary, err := l.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("shutdown error", err)
+	}
+	if summary.Drained != 1 || summary.Aborted != 1 || summary.Unsent == 0 || len(summary.AbortedAddrs) != 1 {
+		t.Errorf("bad summary %+v", summary)
+	}
+	if summary.AbortedAddrs[0].(*net.UDPAddr).Port != stuck.LocalAddr().(*net.UDPAddr).Port {
+		t.Error("wrong session aborted", summary.AbortedAddrs[0])
+	}
+	if n := <-got; n != len(msg) {
+		t.Error("reader got", n, "of", len(msg))
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("accept after shutdown")
+	}
+	select {
+	case <-stuck.quitChan:
+	case <-time.After(time.Second):
+		t.Error("stuck session was not reset")
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			l.Close()
+			done <- true
+		}()
+		go func() {
+			l.Shutdown(context.Background())
+			done <- true
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
+
+func TestCloseWithSessions(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	session, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server := <-accepted
+	l.Close()
+	//the wheel of the listener is gone, its sessions went with it
+	closed := make(chan bool)
+	go func() {
+		if _, err := server.Read(make([]byte, 10)); err == nil {
+			t.Error("read after the listener closed")
+		}
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session hangs after the listener closed")
+	}
+}
@@ -0,0 +1,182 @@
+package ukcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// a session is found by its conv, not by the address it talks from, so a
+// client whose NAT mapping or network changed keeps it: the first packet
+// from a new address starts a path validation, the client proves it knows
+// the secret it sent with SndSYN and only then the listener moves it over
+//
+// This keeps off those who only see packets from the new address, not an
+// on-path observer: the secret goes out in cleartext in SndSYN, or in
+// Resume, and convs come from GetId's counter, so whoever saw the handshake
+// can answer a challenge and move the session to an address of its own.
+// Deriving the secret from both sides would not help as both go in
+// cleartext too, take a transport that encrypts the handshake for that
+//
+//	challenge: [conv 4][PathChallenge][nonce 8]
+//	response:  [conv 4][PathResponse][nonce 8][hmac 16]
+const pathSecretSize = 8
+const pathNonceSize = 8
+const pathMacSize = 16
+
+// a new address is challenged at most this often
+const pathProbeInterval = 250 * time.Millisecond
+
+var errNotDialed = errors.New("only dialed sessions can rebind")
+
+type pathProbe struct {
+	addr  net.Addr
+	shard *listenShard
+	nonce []byte
+	sent  time.Time
+}
+
+func newPathSecret() []byte {
+	b := make([]byte, pathSecretSize)
+	rand.Read(b)
+	return b
+}
+
+func pathMac(secret []byte, conv uint32, nonce []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	var c [4]byte
+	binary.LittleEndian.PutUint32(c[:], conv)
+	m.Write(c[:])
+	m.Write(nonce)
+	return m.Sum(nil)[:pathMacSize]
+}
+
+func isPathFrame(data []byte) bool {
+	return len(data) > 5 && (data[4] == PathChallenge || data[4] == PathResponse)
+}
+
+// sessionConv tells which session a packet from an unknown address claims to be
+func sessionConv(data []byte) (uint32, bool) {
+	if len(data) >= int(ikcp.OVERHEAD) && uint32(data[4]) >= ikcp.CMD_PUSH && uint32(data[4]) <= ikcp.CMD_SACK {
+		return binary.LittleEndian.Uint32(data), true
+	}
+	if isDatagram(data) || isPathFrame(data) || isPMTUFrame(data) {
+		return binary.LittleEndian.Uint32(data), true
+	}
+	return 0, false
+}
+
+// migrateInput handles a packet of this session that came from another
+// address, it reports false if the listener should treat it as a stranger
+func (session *UDPMakeSession) migrateInput(data []byte, from net.Addr, sh *listenShard) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isQuit() || session.status != "ok" || session.pathSecret == nil {
+		return false
+	}
+	conv := uint32(session.id)
+	p := session.pathProbe
+	if p != nil && data[4] == PathResponse && len(data) >= 5+pathNonceSize+pathMacSize &&
+		p.addr.String() == from.String() && p.shard == sh {
+		nonce := data[5 : 5+pathNonceSize]
+		mac := data[5+pathNonceSize : 5+pathNonceSize+pathMacSize]
+		if bytes.Equal(nonce, p.nonce) && hmac.Equal(mac, pathMac(session.pathSecret, conv, nonce)) {
+			session.migrate(from, sh)
+		}
+		return true
+	}
+	if p == nil || p.addr.String() != from.String() || session.wheel.now().Sub(p.sent) >= pathProbeInterval {
+		nonce := make([]byte, pathNonceSize)
+		rand.Read(nonce)
+		session.pathProbe = &pathProbe{addr: from, shard: sh, nonce: nonce, sent: session.wheel.now()}
+		frame := make([]byte, 5+pathNonceSize)
+		binary.LittleEndian.PutUint32(frame, conv)
+		frame[4] = PathChallenge
+		copy(frame[5:], nonce)
+		sh.sock.WriteTo(frame, from)
+	}
+	return true
+}
+
+// migrate moves the validated session to its new address, the lock must be held
+func (session *UDPMakeSession) migrate(to net.Addr, sh *listenShard) {
+	old := session.shard
+	oldAddr := session.remote.String()
+	old.lock.Lock()
+	if old.addrs[oldAddr] == session {
+		delete(old.addrs, oldAddr)
+	}
+	old.lock.Unlock()
+	sh.lock.Lock()
+	sh.addrs[to.String()] = session
+	sh.lock.Unlock()
+	log.Println("session migrated", session.id, oldAddr, "=>", to.String())
+	session.remote = to
+	session.shard = sh
+	session.sock = sh.sock
+	session.pathProbe = nil
+	if session.pmtud != nil && session.pmtud.timer != nil {
+		//another path, maybe another mtu
+		session.pmtuStart()
+	}
+	session.lastRecv = session.wheel.now().UnixNano()
+	//flush what waits for the new address
+	session.scheduleUpdate(0)
+}
+
+// pathInput answers the server's challenge, the lock must be held
+func (session *UDPMakeSession) pathInput(data []byte) {
+	conv := binary.LittleEndian.Uint32(data)
+	if conv != uint32(session.id) || data[4] != PathChallenge || session.pathSecret == nil {
+		return
+	}
+	if len(data) < 5+pathNonceSize {
+		return
+	}
+	nonce := data[5 : 5+pathNonceSize]
+	frame := make([]byte, 5+pathNonceSize+pathMacSize)
+	binary.LittleEndian.PutUint32(frame, conv)
+	frame[4] = PathResponse
+	copy(frame[5:], nonce)
+	copy(frame[5+pathNonceSize:], pathMac(session.pathSecret, conv, nonce))
+	session.sock.WriteTo(frame, session.remote)
+}
+
+// Rebind moves a dialed session to a new local socket, as when the host
+// changed networks, the server follows once it validated the new path
+func (session *UDPMakeSession) Rebind() error {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	if err = session.RebindPacket(sock); err != nil {
+		sock.Close()
+	}
+	return err
+}
+
+// RebindPacket is Rebind onto conn, which the session owns from then on
+func (session *UDPMakeSession) RebindPacket(sock net.PacketConn) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.shard != nil || session.listener != nil {
+		return errNotDialed
+	}
+	if session.isQuit() || session.closed {
+		return errClosed
+	}
+	old := session.sock
+	session.sock = sock
+	//the ping makes the server see the new address at once
+	session.sendFrame(Ping)
+	old.Close()
+	return nil
+}
@@ -0,0 +1,91 @@
+package ukcp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ukcptest"
+)
+
+func TestRebind(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	session, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	echo := func(msg string) {
+		if _, err := session.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		session.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 64)
+		n, err := session.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != msg {
+			t.Fatal("bad echo", string(b[:n]))
+		}
+	}
+	echo("before")
+	old := session.LocalAddr().String()
+	if err := session.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	if session.LocalAddr().String() == old {
+		t.Fatal("same local address after rebind")
+	}
+	echo("after")
+	l.shards[0].lock.Lock()
+	_, bHave := l.shards[0].addrs[old]
+	n := len(l.shards[0].addrs)
+	l.shards[0].lock.Unlock()
+	if bHave || n != 1 {
+		t.Error("old address still indexed", n)
+	}
+}
+
+func TestRebindPacket(t *testing.T) {
+	network := ukcptest.NewNetwork(1)
+	lconn, _ := network.Listen("server:0")
+	l, err := ListenPacket(lconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+	cconn, _ := network.Listen("wifi:0")
+	session, err := DialPacket(cconn, l.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	//the old network is gone at once, like a host leaving its wifi
+	moved, _ := network.Listen("lte:0")
+	if err := session.RebindPacket(moved); err != nil {
+		t.Fatal(err)
+	}
+	session.Write([]byte("after"))
+	session.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 64)
+	n, err := session.Read(b)
+	if err != nil || string(b[:n]) != "after" {
+		t.Fatal("echo after rebind", string(b[:n]), err)
+	}
+	if session.LocalAddr() != moved.LocalAddr() {
+		t.Error("local address", session.LocalAddr())
+	}
+}
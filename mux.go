@@ -0,0 +1,384 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// stream frames travel through kcp as [StreamFrame][type][id 4 bytes][payload]
+const (
+	streamSYN byte = iota
+	streamData
+	streamWnd
+	streamFIN
+	streamRST
+)
+
+const streamHeader = 6
+
+// bytes a stream may have in flight before the reader hands out credit
+const streamWindow = 256 * 1024
+
+// streams opened by the peer and not accepted yet, later ones are reset
+const streamBacklog = 128
+
+var errStreamReset = errors.New("stream reset")
+var errStreamClosed = errors.New("stream closed")
+
+type mux struct {
+	streams       map[uint32]*Stream
+	nextId        uint32
+	accepts       []*Stream
+	acceptWake    chan bool
+	acceptWaiting int
+}
+
+// Stream is one of many reliable byte streams carried by a session,
+// with its own flow control window, FIN and reset
+type Stream struct {
+	id      uint32
+	session *UDPMakeSession
+
+	rcvBuf   [][]byte
+	rcvBytes int
+	consumed int //read by the app but not credited back yet
+	sndWnd   int
+
+	finSent bool
+	finRecv bool
+	reset   bool
+	closed  bool
+
+	readWake      chan bool
+	readWaiting   int
+	writeWake     chan bool
+	writeWaiting  int
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (session *UDPMakeSession) getMux() *mux {
+	if session.mux == nil {
+		m := &mux{streams: make(map[uint32]*Stream), acceptWake: make(chan bool)}
+		//ids of the two sides never collide, the dialer uses odd ones
+		m.nextId = 1
+		if session.shard != nil {
+			m.nextId = 2
+		}
+		session.mux = m
+	}
+	return session.mux
+}
+
+func (session *UDPMakeSession) newStream(id uint32) *Stream {
+	st := &Stream{id: id, session: session, sndWnd: streamWindow, readWake: make(chan bool), writeWake: make(chan bool)}
+	session.getMux().streams[id] = st
+	return st
+}
+
+// OpenStream starts a new stream, the peer gets it from AcceptStream. Peers
+// that only speak 0.1 have no streams
+func (session *UDPMakeSession) OpenStream() (*Stream, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.closed || session.status != "ok" {
+		return nil, errClosed
+	}
+	if session.version < framesVersion {
+		return nil, errOldVersion
+	}
+	m := session.getMux()
+	st := session.newStream(m.nextId)
+	m.nextId += 2
+	session.sendStreamFrame(streamSYN, st.id, nil)
+	return st, nil
+}
+
+// AcceptStream waits for a stream opened by the peer
+func (session *UDPMakeSession) AcceptStream() (*Stream, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	m := session.getMux()
+	for len(m.accepts) == 0 {
+		if session.closed {
+			return nil, errClosed
+		}
+		m.acceptWaiting++
+		session.wait(m.acceptWake, time.Time{})
+		m.acceptWaiting--
+	}
+	st := m.accepts[0]
+	m.accepts[0] = nil
+	m.accepts = m.accepts[1:]
+	return st, nil
+}
+
+func (session *UDPMakeSession) sendStreamFrame(typ byte, id uint32, payload []byte) {
+	buf := make([]byte, streamHeader+len(payload))
+	buf[0] = StreamFrame
+	buf[1] = typ
+	binary.LittleEndian.PutUint32(buf[2:], id)
+	copy(buf[streamHeader:], payload)
+	session.sendMessage(buf)
+	session.scheduleUpdate(10 * time.Millisecond)
+}
+
+func (session *UDPMakeSession) sendStreamWnd(id uint32, n int) {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+	session.sendStreamFrame(streamWnd, id, buf)
+}
+
+// muxInput handles a stream frame drained from kcp, the lock must be held
+func (session *UDPMakeSession) muxInput(data []byte) {
+	if len(data) < streamHeader-1 {
+		return
+	}
+	typ := data[0]
+	id := binary.LittleEndian.Uint32(data[1:])
+	payload := data[streamHeader-1:]
+	m := session.getMux()
+	st, bHave := m.streams[id]
+	if typ == streamSYN {
+		if bHave {
+			return
+		}
+		if len(m.accepts) >= streamBacklog {
+			session.sendStreamFrame(streamRST, id, nil)
+			return
+		}
+		m.accepts = append(m.accepts, session.newStream(id))
+		broadcast(&m.acceptWake, m.acceptWaiting)
+		return
+	}
+	if !bHave {
+		if typ != streamRST {
+			session.sendStreamFrame(streamRST, id, nil)
+		}
+		return
+	}
+	switch typ {
+	case streamData:
+		if st.closed {
+			//nobody will read it, give the credit straight back
+			session.sendStreamWnd(id, len(payload))
+			break
+		}
+		if st.rcvBytes+len(payload) > streamWindow {
+			st.resetLocked()
+			break
+		}
+		b := make([]byte, len(payload))
+		copy(b, payload)
+		st.rcvBuf = append(st.rcvBuf, b)
+		st.rcvBytes += len(b)
+		broadcast(&st.readWake, st.readWaiting)
+	case streamWnd:
+		if len(payload) >= 4 {
+			st.sndWnd += int(binary.LittleEndian.Uint32(payload))
+			broadcast(&st.writeWake, st.writeWaiting)
+		}
+	case streamFIN:
+		st.finRecv = true
+		broadcast(&st.readWake, st.readWaiting)
+		if st.finSent {
+			delete(m.streams, id)
+		}
+	case streamRST:
+		st.reset = true
+		broadcast(&st.readWake, st.readWaiting)
+		broadcast(&st.writeWake, st.writeWaiting)
+		delete(m.streams, id)
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (n int, err error) {
+	session := st.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for {
+		if len(st.rcvBuf) > 0 {
+			for len(st.rcvBuf) > 0 && n < len(p) {
+				c := copy(p[n:], st.rcvBuf[0])
+				n += c
+				if c < len(st.rcvBuf[0]) {
+					st.rcvBuf[0] = st.rcvBuf[0][c:]
+				} else {
+					st.rcvBuf[0] = nil
+					st.rcvBuf = st.rcvBuf[1:]
+				}
+			}
+			st.rcvBytes -= n
+			st.consumed += n
+			if st.consumed >= streamWindow/2 && !st.reset && !session.isQuit() {
+				session.sendStreamWnd(st.id, st.consumed)
+				st.consumed = 0
+			}
+			return n, nil
+		}
+		if st.reset {
+			return 0, errStreamReset
+		}
+		if st.finRecv {
+			return 0, io.EOF
+		}
+		if st.closed {
+			return 0, errStreamClosed
+		}
+		if session.isQuit() {
+			return 0, session.readErr()
+		}
+		st.readWaiting++
+		err = session.wait(st.readWake, st.readDeadline)
+		st.readWaiting--
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	session := st.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for len(b) > 0 {
+		if st.reset {
+			return n, errStreamReset
+		}
+		if st.finSent || st.closed {
+			return n, errStreamClosed
+		}
+		if session.closed {
+			return n, session.writeErr()
+		}
+		if st.sndWnd <= 0 {
+			st.writeWaiting++
+			err = session.wait(st.writeWake, st.writeDeadline)
+			st.writeWaiting--
+		} else if session.kcp.Waitsnd() > dataLimit {
+			session.writeWaiting++
+			err = session.wait(session.writeWake, st.writeDeadline)
+			session.writeWaiting--
+		} else {
+			sendL := len(b)
+			if sendL > st.sndWnd {
+				sendL = st.sndWnd
+			}
+			if sendL > dataLimit-streamHeader {
+				sendL = dataLimit - streamHeader
+			}
+			session.sendStreamFrame(streamData, st.id, b[:sendL])
+			st.sndWnd -= sendL
+			n += sendL
+			b = b[sendL:]
+		}
+		if err != nil {
+			return
+		}
+	}
+	return n, nil
+}
+
+// CloseWrite sends FIN after the queued data, the peer reads io.EOF
+// while this side can still read what it sends back
+func (st *Stream) CloseWrite() error {
+	session := st.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if st.finSent || st.reset || session.isQuit() {
+		return nil
+	}
+	st.finSent = true
+	broadcast(&st.writeWake, st.writeWaiting)
+	session.sendStreamFrame(streamFIN, st.id, nil)
+	if st.finRecv {
+		delete(session.getMux().streams, st.id)
+	}
+	return nil
+}
+
+// Close sends FIN and stops reading, the stream is gone once the peer's FIN arrives
+func (st *Stream) Close() error {
+	session := st.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if st.closed {
+		return nil
+	}
+	st.closed = true
+	broadcast(&st.readWake, st.readWaiting)
+	broadcast(&st.writeWake, st.writeWaiting)
+	if st.reset || session.isQuit() {
+		return nil
+	}
+	if !st.finSent {
+		st.finSent = true
+		session.sendStreamFrame(streamFIN, st.id, nil)
+	}
+	if st.finRecv {
+		delete(session.getMux().streams, st.id)
+	}
+	return nil
+}
+
+// Reset aborts the stream in both directions, pending data is dropped
+func (st *Stream) Reset() error {
+	session := st.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if st.reset {
+		return nil
+	}
+	st.resetLocked()
+	return nil
+}
+
+func (st *Stream) resetLocked() {
+	session := st.session
+	st.reset = true
+	st.rcvBuf = nil
+	st.rcvBytes = 0
+	broadcast(&st.readWake, st.readWaiting)
+	broadcast(&st.writeWake, st.writeWaiting)
+	delete(session.getMux().streams, st.id)
+	if !session.isQuit() {
+		session.sendStreamFrame(streamRST, st.id, nil)
+	}
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.session.lock.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.session.lock.Unlock()
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.session.lock.Lock()
+	st.readDeadline = t
+	st.session.lock.Unlock()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.session.lock.Lock()
+	st.writeDeadline = t
+	st.session.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,64 @@
+package ukcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStreams(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		session := conn.(*UDPMakeSession)
+		for {
+			st, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+	session, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	//more than a window each, so credit has to flow back
+	payload := bytes.Repeat([]byte("0123456789"), streamWindow/5)
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		st, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			st.Write(payload)
+			st.CloseWrite()
+		}()
+		go func() {
+			b, err := ioutil.ReadAll(st)
+			if err == nil && !bytes.Equal(b, payload) {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package ukcp
+
+import (
+	"encoding/binary"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// from version 0.2 on FirstSYN carries the dialer's wishes as options and
+// FirstACK the values the listener settled on, both sides apply those to
+// kcp before the session is "ok". An option is [type][length][value],
+// types a peer does not know are skipped
+//
+//	FirstSYN: [FirstSYN][arg 4][minMain][minSub][options...]
+//	FirstACK: [FirstACK][id 4][main][sub][options...]
+const optionsVersion = Version(0)<<8 | 2
+
+const (
+	optMTU     byte = 1 //[mtu 2]
+	optWindow  byte = 2 //[snd 2][rcv 2] of the sender
+	optNoDelay byte = 3 //[nodelay][interval 2][resend][nc]
+	optStream  byte = 4 //[1], from 0.6 on
+	optRcvMax  byte = 5 //[max rcv 2] the autotuned window may grow to
+	optAckFreq byte = 6 //[nodelay][count][delay 2] how the sender wants its data acked
+)
+
+const (
+	defaultWnd = 128
+	minMTU     = 256
+	maxMTU     = 1500
+)
+
+var defaultNoDelay = NoDelay{NoDelay: 1, Interval: 10, Resend: 2, NC: 1}
+
+// NoDelay is what ikcp's Nodelay takes
+type NoDelay struct {
+	NoDelay  int
+	Interval int
+	Resend   int
+	NC       int
+}
+
+// what a side wants or what the handshake settled on
+type kcpOptions struct {
+	mtu      int
+	sndWnd   int
+	rcvWnd   int
+	noDelay  NoDelay
+	explicit bool //noDelay was set in the config, not a default
+	stream   bool
+	rcvMax   int //autotuning cap in segments, 0 when the window is fixed
+
+	ask       ikcp.AckPolicy //how this side wants its data acked
+	asked     bool
+	peerAsk   ikcp.AckPolicy //how the peer wants its data acked
+	peerAsked bool
+}
+
+func (c *Config) kcpOptions() *kcpOptions {
+	//a send window left to the default is settled in the handshake
+	o := &kcpOptions{mtu: clampMTU(c.MTU), sndWnd: c.SndWnd, rcvWnd: c.RcvWnd, noDelay: defaultNoDelay, stream: c.StreamMode}
+	if o.sndWnd < 0 || o.sndWnd > 0xffff {
+		o.sndWnd = defaultWnd
+	}
+	if o.rcvWnd <= 0 || o.rcvWnd > 0xffff {
+		o.rcvWnd = defaultWnd
+	}
+	if c.RcvBufMax > 0 {
+		mtu := o.mtu
+		if mtu == 0 {
+			mtu = int(ikcp.MTU_DEF)
+		}
+		o.rcvMax = c.RcvBufMax / (mtu - int(ikcp.OVERHEAD))
+		if o.rcvMax > 0xffff {
+			o.rcvMax = 0xffff
+		} else if o.rcvMax <= o.rcvWnd {
+			o.rcvMax = 0
+		}
+	}
+	if c.NoDelay != nil {
+		o.noDelay = *c.NoDelay
+		o.explicit = true
+	}
+	if c.AckFrequency != nil {
+		o.ask = *c.AckFrequency
+		if o.ask.Count > 0xff {
+			o.ask.Count = 0xff
+		}
+		if o.ask.Delay > 0xffff {
+			o.ask.Delay = 0xffff
+		}
+		o.asked = true
+	}
+	return o
+}
+
+func (o *kcpOptions) encode(b []byte) []byte {
+	if o.mtu != 0 {
+		b = append(b, optMTU, 2, 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(o.mtu))
+	}
+	b = append(b, optWindow, 4, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(b[len(b)-4:], uint16(o.sndWnd))
+	binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(o.rcvWnd))
+	if o.explicit {
+		nd := o.noDelay
+		b = append(b, optNoDelay, 5, byte(nd.NoDelay), 0, 0, byte(nd.Resend), byte(nd.NC))
+		binary.LittleEndian.PutUint16(b[len(b)-4:], uint16(nd.Interval))
+	}
+	if o.stream {
+		b = append(b, optStream, 1, 1)
+	}
+	if o.rcvMax > 0 {
+		b = append(b, optRcvMax, 2, 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(o.rcvMax))
+	}
+	if o.asked {
+		nd := byte(0)
+		if o.ask.NoDelay {
+			nd = 1
+		}
+		b = append(b, optAckFreq, 4, nd, byte(o.ask.Count), 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(o.ask.Delay))
+	}
+	return b
+}
+
+// parseOptions reads what the peer sent, anything truncated or unknown is left out
+func parseOptions(b []byte) *kcpOptions {
+	o := &kcpOptions{}
+	for len(b) >= 2 {
+		t, l := b[0], int(b[1])
+		if len(b) < 2+l {
+			break
+		}
+		v := b[2 : 2+l]
+		b = b[2+l:]
+		switch {
+		case t == optMTU && l >= 2:
+			o.mtu = int(binary.LittleEndian.Uint16(v))
+		case t == optWindow && l >= 4:
+			o.sndWnd = int(binary.LittleEndian.Uint16(v))
+			o.rcvWnd = int(binary.LittleEndian.Uint16(v[2:]))
+		case t == optNoDelay && l >= 5:
+			o.noDelay = NoDelay{NoDelay: int(v[0]), Interval: int(binary.LittleEndian.Uint16(v[1:])), Resend: int(v[3]), NC: int(v[4])}
+			o.explicit = true
+		case t == optStream && l >= 1:
+			o.stream = v[0] == 1
+		case t == optRcvMax && l >= 2:
+			o.rcvMax = int(binary.LittleEndian.Uint16(v))
+		case t == optAckFreq && l >= 4:
+			o.ask = ikcp.AckPolicy{NoDelay: v[0] == 1, Count: uint32(v[1]), Delay: uint32(binary.LittleEndian.Uint16(v[2:]))}
+			o.asked = true
+		}
+	}
+	return o
+}
+
+// settle is what the listener with options o answers to the dialer's peer,
+// the window is the listener's own, the dialer caps its send window with it
+func (o *kcpOptions) settle(peer *kcpOptions) *kcpOptions {
+	s := *o
+	if peer.mtu != 0 && (s.mtu == 0 || peer.mtu < s.mtu) {
+		s.mtu = clampMTU(peer.mtu)
+	}
+	if !s.explicit && peer.explicit {
+		s.noDelay = peer.noDelay
+		s.explicit = true
+	}
+	s.capSnd(peer)
+	//either side may ask for stream mode
+	s.stream = s.stream || peer.stream
+	s.peerAsk, s.peerAsked = peer.ask, peer.asked
+	return &s
+}
+
+// accept is what the dialer with options o applies from the listener's answer
+func (o *kcpOptions) accept(peer *kcpOptions) *kcpOptions {
+	s := *o
+	s.mtu = clampMTU(peer.mtu)
+	if peer.explicit {
+		s.noDelay = peer.noDelay
+	}
+	s.capSnd(peer)
+	s.stream = peer.stream
+	s.peerAsk, s.peerAsked = peer.ask, peer.asked
+	return &s
+}
+
+// clampMTU keeps an mtu within what kcp is given, 0 stays kcp's default
+func clampMTU(mtu int) int {
+	if mtu == 0 {
+		return 0
+	}
+	if mtu < minMTU {
+		return minMTU
+	}
+	if mtu > maxMTU {
+		return maxMTU
+	}
+	return mtu
+}
+
+// capSnd keeps the send window within the peer's receive window, or within
+// what that may grow to when the peer autotunes. A send window left to the
+// default goes that far behind a congestion window, without one kcp would
+// send all of it at once
+func (s *kcpOptions) capSnd(peer *kcpOptions) {
+	limit := peer.rcvWnd
+	if peer.rcvMax > limit {
+		limit = peer.rcvMax
+	}
+	if s.sndWnd == 0 {
+		s.sndWnd = defaultWnd
+		if s.noDelay.NC == 0 && peer.rcvMax > s.sndWnd {
+			s.sndWnd = peer.rcvMax
+		}
+	}
+	if limit > 0 && limit < s.sndWnd {
+		s.sndWnd = limit
+	}
+}
+
+func (o *kcpOptions) apply(kcp *ikcp.Ikcpcb) {
+	if o.mtu != 0 {
+		kcp.Setmtu(int32(o.mtu))
+	}
+	snd := o.sndWnd
+	if snd == 0 {
+		snd = defaultWnd
+	}
+	kcp.Wndsize(int32(snd), int32(o.rcvWnd))
+	nd := o.noDelay
+	kcp.Nodelay(int32(nd.NoDelay), int32(nd.Interval), int32(nd.Resend), int32(nd.NC))
+	kcp.SetStream(o.stream)
+	if o.peerAsked {
+		kcp.SetAckPolicy(o.peerAsk)
+	}
+}
@@ -0,0 +1,169 @@
+package ukcp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+func TestParseOptions(t *testing.T) {
+	o := (&Config{MTU: 1200, SndWnd: 300, RcvWnd: 64, NoDelay: &NoDelay{0, 40, 0, 0}}).kcpOptions()
+	b := o.encode(nil)
+	//an option from the future and a truncated one are skipped
+	b = append([]byte{200, 3, 1, 2, 3}, b...)
+	b = append(b, optMTU, 2, 1)
+	p := parseOptions(b)
+	if *p != *o {
+		t.Errorf("parsed %+v, sent %+v", *p, *o)
+	}
+}
+
+func TestSettleOptions(t *testing.T) {
+	server := (&Config{SndWnd: 256, NoDelay: &NoDelay{0, 30, 0, 0}}).kcpOptions()
+	client := (&Config{MTU: 1000, SndWnd: 512, RcvWnd: 64}).kcpOptions()
+	s := server.settle(parseOptions(client.encode(nil)))
+	if s.mtu != 1000 || s.sndWnd != 64 || s.rcvWnd != defaultWnd || s.noDelay.Interval != 30 {
+		t.Errorf("server settled on %+v", *s)
+	}
+	c := client.accept(parseOptions(s.encode(nil)))
+	if c.mtu != 1000 || c.sndWnd != defaultWnd || c.rcvWnd != 64 || c.noDelay.Interval != 30 {
+		t.Errorf("client settled on %+v", *c)
+	}
+}
+
+func TestSettleMTU(t *testing.T) {
+	//the peer's mtu comes off the wire, it stays within what we give kcp
+	for _, mtu := range []int{1, 65535} {
+		peer := &kcpOptions{mtu: mtu, rcvWnd: defaultWnd}
+		want := minMTU
+		if mtu > maxMTU {
+			want = maxMTU
+		}
+		if s := (&Config{}).kcpOptions().settle(peer); s.mtu != want {
+			t.Error("settled", mtu, "=>", s.mtu)
+		}
+		if c := (&Config{}).kcpOptions().accept(peer); c.mtu != want {
+			t.Error("accepted", mtu, "=>", c.mtu)
+		}
+	}
+}
+
+func TestSettleAutoTune(t *testing.T) {
+	client := (&Config{RcvBufMax: 1 << 20}).kcpOptions()
+	want := (1 << 20) / (int(ikcp.MTU_DEF) - int(ikcp.OVERHEAD))
+	if client.rcvMax != want {
+		t.Fatal("rcvMax", client.rcvMax)
+	}
+	//a default send window goes as far as the autotuned one may grow,
+	//behind a congestion window only
+	s := (&Config{NoDelay: &NoDelay{1, 10, 2, 0}}).kcpOptions().settle(parseOptions(client.encode(nil)))
+	if s.sndWnd != want {
+		t.Error("default send window", s.sndWnd)
+	}
+	s = (&Config{}).kcpOptions().settle(parseOptions(client.encode(nil)))
+	if s.sndWnd != defaultWnd {
+		t.Error("default send window without a congestion window", s.sndWnd)
+	}
+	s = (&Config{SndWnd: 200}).kcpOptions().settle(parseOptions(client.encode(nil)))
+	if s.sndWnd != 200 {
+		t.Error("configured send window", s.sndWnd)
+	}
+	c := client.accept(parseOptions(s.encode(nil)))
+	if c.sndWnd != defaultWnd || c.rcvMax != want {
+		t.Errorf("client settled on %+v", *c)
+	}
+}
+
+func TestSettleAckFrequency(t *testing.T) {
+	ask := ikcp.AckPolicy{Count: 8, Delay: 20}
+	client := (&Config{AckFrequency: &ask}).kcpOptions()
+	o := parseOptions(client.encode(nil))
+	if !o.asked || o.ask != ask {
+		t.Fatalf("parsed %+v", o.ask)
+	}
+	s := (&Config{}).kcpOptions().settle(o)
+	if !s.peerAsked || s.peerAsk != ask {
+		t.Errorf("server settled on %+v", s.peerAsk)
+	}
+	//the server asked for nothing, the client keeps its own policy
+	c := client.accept(parseOptions(s.encode(nil)))
+	if c.peerAsked {
+		t.Errorf("client settled on %+v", c.peerAsk)
+	}
+}
+
+func TestOptionsHandshake(t *testing.T) {
+	l, err := (&ListenConfig{Config: Config{MTU: 1200}}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPMakeSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.(*UDPMakeSession)
+	}()
+	session, err := DialWithConfig(l.Addr().String(), &Config{MTU: 800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server := <-accepted
+	if a, b := session.MaxDatagramSize(), server.MaxDatagramSize(); a != 800-datagramHeader || a != b {
+		t.Error("mtu not settled", a, b)
+	}
+	//a 0.1 dialer sends no options, each side keeps its own config
+	old, err := DialWithConfig(l.Addr().String(), &Config{MTU: 800, MaxVersion: MakeVersion(0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if old.Version() != MakeVersion(0, 1) || old.MaxDatagramSize() != 800-datagramHeader {
+		t.Error("0.1 session", old.Version(), old.MaxDatagramSize())
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	l, err := (&ListenConfig{Config: Config{RcvBufMax: 4 << 20}, RcvMemory: 64 << 20}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPMakeSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.(*UDPMakeSession)
+	}()
+	//without a congestion window a grown window would be sent in one burst
+	session, err := DialWithConfig(l.Addr().String(), &Config{NoDelay: &NoDelay{1, 10, 2, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server := <-accepted
+	payload := make([]byte, 4<<20)
+	go session.Write(payload)
+	server.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.ReadFull(server, payload); err != nil {
+		t.Fatal(err)
+	}
+	server.lock.Lock()
+	wnd := server.kcp.RcvWnd()
+	server.lock.Unlock()
+	if wnd <= defaultWnd {
+		t.Error("window did not grow", wnd)
+	}
+	server.Close()
+	server.closeOverLocked()
+	if used := l.rcvMemory.Used(); used != 0 {
+		t.Error("memory not released", used)
+	}
+}
@@ -0,0 +1,194 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// path mtu discovery in the way of DPLPMTUD: padded probes the peer acks
+// outside kcp, so a lost probe costs nothing but the probe. The search
+// starts by confirming the mtu kcp has, goes up by halving the gap to the
+// smallest size that failed, and falls back to pmtuBase when the confirmed
+// size stops getting through
+//
+//	probe: [conv 4][PMTUProbe][id 4][size 2][padding up to size]
+//	ack:   [conv 4][PMTUAck][id 4][size 2]
+const (
+	pmtuHeader = 11
+	pmtuBase   = 1200 //assumed to always get through
+	pmtuMax    = 1472 //an ethernet frame without the ip and udp headers
+	pmtuMax6   = 1452 //the same over ipv6
+	pmtuStep   = 16   //the search stops when the gap gets that small
+	pmtuTries  = 3    //a size failed after that many lost probes
+
+	pmtuProbeTimeout   = 500 * time.Millisecond
+	pmtuConfirmEvery   = 30 * time.Second
+	pmtuRaiseAfterRuns = 20 //confirm runs before trying to go higher again
+)
+
+// peers before 0.3 do not ack probes
+const pmtuVersion = Version(0)<<8 | 3
+
+type pmtud struct {
+	timer   *wheelTimer
+	limit   int //the mtu the handshake settled on, 0 if none
+	max     int //the largest size searched on this path
+	lo      int //largest size acked on this path, 0 before the first ack
+	hi      int //smallest size that failed
+	probing int //size of the probe in flight, 0 when idle
+	id      uint32
+	tries   int
+	runs    int
+}
+
+func isPMTUFrame(data []byte) bool {
+	return len(data) >= pmtuHeader && (data[4] == PMTUProbe || data[4] == PMTUAck)
+}
+
+// pmtuStart begins the search on a session that just became "ok", the lock must be held
+func (session *UDPMakeSession) pmtuStart() {
+	p := session.pmtud
+	if p == nil {
+		return
+	}
+	if p.timer == nil {
+		p.timer = session.wheel.newTimer(session.onPMTU)
+	}
+	p.max = pmtuMaxFor(session.remote)
+	if p.limit > 0 && p.limit < p.max {
+		p.max = p.limit
+	}
+	p.lo, p.hi, p.probing, p.tries, p.runs = 0, p.max+1, 0, 0, 0
+	session.pmtuNext()
+}
+
+// pmtuMaxFor is the largest datagram an ethernet frame takes to addr
+func pmtuMaxFor(addr net.Addr) int {
+	host, _, err := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.To4() == nil {
+		return pmtuMax6
+	}
+	return pmtuMax
+}
+
+// pmtuNext sends the next probe or, with nothing left to find, waits to confirm
+func (session *UDPMakeSession) pmtuNext() {
+	p := session.pmtud
+	size := 0
+	if p.lo == 0 {
+		size = int(session.kcp.Mtu())
+	} else if p.hi-p.lo > pmtuStep {
+		size = (p.lo + p.hi) / 2
+	}
+	if size == 0 {
+		p.probing = 0
+		p.timer.reset(pmtuConfirmEvery)
+		return
+	}
+	if size != p.probing {
+		p.probing = size
+		p.tries = 0
+	}
+	session.sendPMTUProbe(size)
+}
+
+func (session *UDPMakeSession) sendPMTUProbe(size int) {
+	p := session.pmtud
+	p.id++
+	p.tries++
+	frame := make([]byte, size)
+	binary.LittleEndian.PutUint32(frame, uint32(session.id))
+	frame[4] = PMTUProbe
+	binary.LittleEndian.PutUint32(frame[5:], p.id)
+	binary.LittleEndian.PutUint16(frame[9:], uint16(size))
+	session.sock.WriteTo(frame, session.remote)
+	p.timer.reset(pmtuProbeTimeout)
+}
+
+func (session *UDPMakeSession) onPMTU() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	p := session.pmtud
+	if session.isQuit() || session.closed || p == nil {
+		return
+	}
+	if p.probing == 0 {
+		//time to check the path still takes what we use
+		p.runs++
+		if p.runs >= pmtuRaiseAfterRuns {
+			p.runs = 0
+			p.hi = p.max + 1
+		}
+		p.probing = p.lo
+		p.tries = 0
+		session.sendPMTUProbe(p.lo)
+		return
+	}
+	if p.tries < pmtuTries {
+		session.sendPMTUProbe(p.probing)
+		return
+	}
+	//the size does not get through
+	failed := p.probing
+	p.hi = failed
+	if failed <= p.lo || p.lo == 0 {
+		//what kcp uses is a black hole now
+		p.lo = pmtuBase
+		if failed < p.lo {
+			p.lo = failed
+		}
+		if p.hi <= p.lo {
+			p.hi = p.lo + 1
+		}
+		//kcp cuts what is queued again, segments already sent keep their
+		//size and get through once the path takes them or not at all
+		session.kcp.Setmtu(int32(p.lo))
+	}
+	p.probing = 0
+	session.pmtuNext()
+}
+
+// pmtuInput acks the peer's probes and takes the acks of ours, the lock must be held
+func (session *UDPMakeSession) pmtuInput(data []byte) {
+	if binary.LittleEndian.Uint32(data) != uint32(session.id) {
+		return
+	}
+	size := int(binary.LittleEndian.Uint16(data[9:]))
+	if data[4] == PMTUProbe {
+		if size != len(data) {
+			return
+		}
+		ack := make([]byte, pmtuHeader)
+		copy(ack, data[:pmtuHeader])
+		ack[4] = PMTUAck
+		session.sock.WriteTo(ack, session.remote)
+		return
+	}
+	p := session.pmtud
+	//any try of the size in flight will do
+	if p == nil || p.probing == 0 || size != p.probing {
+		return
+	}
+	if size > p.lo {
+		p.lo = size
+	}
+	if p.hi <= p.lo {
+		p.hi = p.max + 1
+	}
+	if int(session.kcp.Mtu()) != p.lo {
+		session.kcp.Setmtu(int32(p.lo))
+	}
+	p.probing = 0
+	session.pmtuNext()
+}
+
+// PathMTU is the largest datagram the session sends, the mtu kcp uses
+func (session *UDPMakeSession) PathMTU() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.kcp == nil {
+		return 0
+	}
+	return int(session.kcp.Mtu())
+}
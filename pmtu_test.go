@@ -0,0 +1,119 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+func TestPathMTU(t *testing.T) {
+	l, err := (&ListenConfig{Config: Config{DiscoverMTU: true}}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	session, err := DialWithConfig(l.Addr().String(), &Config{DiscoverMTU: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	//loopback takes anything, the search ends just below pmtuMax
+	for i := 0; ; i++ {
+		mtu := session.PathMTU()
+		if mtu > pmtuMax-pmtuStep && mtu <= pmtuMax {
+			break
+		}
+		if i > 50 {
+			t.Fatal("path mtu stuck at", mtu)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := session.MaxDatagramSize(); n != session.PathMTU()-datagramHeader {
+		t.Error("datagrams do not follow the path mtu", n)
+	}
+}
+
+func TestPathMTUBlackHole(t *testing.T) {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	w := newTimerWheel(ikcp.SystemClock)
+	w.stop()
+	//nobody listens there, every probe gets lost
+	session := newSession(sock, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, w)
+	session.id = 1
+	session.version = maxVersion
+	session.pmtud = &pmtud{}
+	session.lock.Lock()
+	session.start()
+	session.lock.Unlock()
+	if mtu := session.PathMTU(); mtu != int(ikcp.MTU_DEF) || session.pmtud.probing != mtu {
+		t.Fatal("not confirming the current mtu", mtu, session.pmtud.probing)
+	}
+	for i := 0; i < pmtuTries; i++ {
+		session.onPMTU()
+	}
+	if mtu := session.PathMTU(); mtu != pmtuBase {
+		t.Fatal("no fall back to base", mtu)
+	}
+	//the first size of the new search gets through
+	size := session.pmtud.probing
+	if size <= pmtuBase || size >= int(ikcp.MTU_DEF) {
+		t.Fatal("bad probe size", size)
+	}
+	ack := make([]byte, pmtuHeader)
+	binary.LittleEndian.PutUint32(ack, 1)
+	ack[4] = PMTUAck
+	binary.LittleEndian.PutUint16(ack[9:], uint16(size))
+	session.lock.Lock()
+	session.pmtuInput(ack)
+	session.lock.Unlock()
+	if mtu := session.PathMTU(); mtu != size {
+		t.Error("mtu not raised to the acked size", mtu)
+	}
+}
+
+func TestPathMTULimit(t *testing.T) {
+	l, err := (&ListenConfig{Config: Config{DiscoverMTU: true}}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	session, err := DialWithConfig(l.Addr().String(), &Config{DiscoverMTU: true, MTU: 1300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	//the search stays below the mtu both sides settled on
+	for i := 0; i < 25; i++ {
+		if mtu := session.PathMTU(); mtu > 1300 {
+			t.Fatal("path mtu above the negotiated one", mtu)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if max := pmtuMaxFor(&net.UDPAddr{IP: net.IPv6loopback, Port: 9}); max != pmtuMax6 {
+		t.Error("ipv6 max", max)
+	}
+	if max := pmtuMaxFor(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); max != pmtuMax {
+		t.Error("ipv4 max", max)
+	}
+}
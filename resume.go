@@ -0,0 +1,242 @@
+package ukcp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// resumption: a listener hands established sessions of 0.4 and later a
+// ticket sealed with a key only it knows, holding the version and the kcp
+// options it settled on. Dialing with that ticket skips the FirstSYN round,
+// one Resume carries it along with early data. ResumeACK answers with a
+// token, the session opens once the dialer echoes it in SndSYN from the
+// address the Resume came from, so a Resume sent again from a spoofed
+// address opens nothing and gets no more than its own size back. The
+// ticket is sent once the dialer's first kcp packet shows it is through
+// the handshake, before that our kcp could be read as the answer it waits for
+//
+//	Ticket:    [Ticket][nonce 12][sealed: issued 8][version 2][options...] as a kcp message
+//	Resume:    [Resume][arg 4][minMain][minSub][secret 8][ticket length 2][ticket][early data]
+//	ResumeACK: [ResumeACK][id 4][main][sub][early data taken][token 8][options...]
+//	SndSYN:    [SndSYN][id 4][token 8], SndACK opens the session as in the full handshake
+//
+// Early data can be replayed: whoever captured a Resume can send it again
+// from its own address and the listener opens another session that reads
+// the same early data. Only send there what is safe to receive twice, or
+// set Disable0RTT on the listener. A ticket the listener refuses gets a
+// Reset, the dialer then falls back to the full handshake and writes its
+// early data afterwards
+const resumeVersion = Version(0)<<8 | 4
+
+const resumeHeader = 17
+const resumeTokenSize = 8
+const ticketLifetime = 24 * time.Hour
+
+var ticketAAD = []byte("ukcp ticket")
+
+func newTicketKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func (l *Listener) sealTicket(version Version, opts *kcpOptions) []byte {
+	aead := l.ticketAEAD
+	plain := make([]byte, 10, 32)
+	binary.LittleEndian.PutUint64(plain, uint64(l.wheel.now().Unix()))
+	binary.LittleEndian.PutUint16(plain[8:], uint16(version))
+	plain = opts.encode(plain)
+	b := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(b)
+	return aead.Seal(b, b, plain, ticketAAD)
+}
+
+func (l *Listener) openTicket(ticket []byte) (Version, *kcpOptions, bool) {
+	aead := l.ticketAEAD
+	ns := aead.NonceSize()
+	if len(ticket) < ns+aead.Overhead() {
+		return 0, nil, false
+	}
+	plain, err := aead.Open(nil, ticket[:ns], ticket[ns:], ticketAAD)
+	if err != nil || len(plain) < 10 {
+		return 0, nil, false
+	}
+	issued := time.Unix(int64(binary.LittleEndian.Uint64(plain)), 0)
+	if age := l.wheel.now().Sub(issued); age < 0 || age > ticketLifetime {
+		return 0, nil, false
+	}
+	return Version(binary.LittleEndian.Uint16(plain[8:])), parseOptions(plain[10:]), true
+}
+
+// sendTicket gives the dialer what it needs to come back, the lock must be held
+func (session *UDPMakeSession) sendTicket(opts *kcpOptions) {
+	ticket := session.listener.sealTicket(session.version, opts)
+	data := make([]byte, 1+len(ticket))
+	data[0] = Ticket
+	copy(data[1:], ticket)
+	session.sendMessage(data)
+	session.scheduleUpdate(10 * time.Millisecond)
+}
+
+// ResumptionTicket is the last ticket the listener sent, nil before the
+// first one came. Put it in Config.Ticket to resume on the next dial
+func (session *UDPMakeSession) ResumptionTicket() []byte {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.ticket
+}
+
+// a dialer that did not get ResumeACK sends Resume again, it can not be
+// a kcp packet as those have their cmd where Resume has the main version
+func isResume(data []byte) bool {
+	return len(data) >= resumeHeader && data[0] == Resume && data[4] < byte(StreamFrame)
+}
+
+// serverResume opens the session from a Resume, the lock must be held
+func (session *UDPMakeSession) serverResume(data []byte) {
+	l := session.listener
+	_, arg := makeDecode(data)
+	n := int(binary.LittleEndian.Uint16(data[15:]))
+	if len(data) < resumeHeader+n {
+		session.refuse()
+		return
+	}
+	version, opts, ok := l.openTicket(data[resumeHeader : resumeHeader+n])
+	minV, maxV := l.config.versions()
+	peerMin, peerMax := MakeVersion(data[5], data[6]), MakeVersion(byte(arg>>24), byte(arg>>16))
+	if !ok || version < resumeVersion || version < minV || version > maxV || version < peerMin || version > peerMax {
+		log.Println("resume refused", session.remote)
+		session.refuse()
+		return
+	}
+	session.version = version
+	session.idleTimeout = time.Duration(arg&0xff) * time.Second
+	l.config.apply(session)
+	session.opts = opts
+	session.pathSecret = append([]byte(nil), data[7:7+pathSecretSize]...)
+	early := data[resumeHeader+n:]
+	taken := byte(0)
+	if len(early) > 0 && !l.config.Disable0RTT {
+		//read once the dialer proved its address
+		session.rcvQueue = append(session.rcvQueue, append([]byte(nil), early...))
+		taken = 1
+	}
+	session.resumeToken = make([]byte, resumeTokenSize)
+	rand.Read(session.resumeToken)
+	ack := make([]byte, 8, 32)
+	makeEncode(ack, ResumeACK, session.id)
+	ack[5], ack[6], ack[7] = version.Main(), version.Sub(), taken
+	ack = append(ack, session.resumeToken...)
+	session.resumeAck = opts.encode(ack)
+	session.status = "resumeack"
+	session.sock.WriteTo(session.resumeAck, session.remote)
+	session.lastRecv = session.wheel.now().UnixNano()
+	session.handshakeTimer.reset(handshakeInterval)
+}
+
+// resumeConfirm opens a resumed session once the dialer echoed the token of
+// ResumeACK, the lock must be held
+func (session *UDPMakeSession) resumeConfirm(data []byte) {
+	if isResume(data) {
+		session.sock.WriteTo(session.resumeAck, session.remote)
+		return
+	}
+	status, arg := makeDecode(data)
+	if status != SndSYN || int(arg) != session.id || len(data) < 5+resumeTokenSize ||
+		subtle.ConstantTimeCompare(data[5:5+resumeTokenSize], session.resumeToken) != 1 {
+		session.closeOver()
+		return
+	}
+	session.handshakeTimer.stop()
+	select {
+	case session.listener.connChan <- session:
+	default:
+		log.Println("accept backlog full,reset", session.remote)
+		session.refuse()
+		return
+	}
+	session.start()
+	session.sock.WriteTo(makeEncode(session.encodeBuffer, SndACK, session.id), session.remote)
+}
+
+func (session *UDPMakeSession) refuse() {
+	session.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
+	session.closeOver()
+}
+
+// dialResume tries to skip the handshake with config.Ticket, it reports how
+// much of early the listener took and false if the full handshake is needed
+func (session *UDPMakeSession) dialResume(config *Config, early []byte, sec int) (int, bool) {
+	minV, maxV := config.versions()
+	if maxV < resumeVersion || len(config.Ticket) > 0xffff {
+		return 0, false
+	}
+	opts := config.kcpOptions()
+	session.pathSecret = newPathSecret()
+	info := make([]byte, resumeHeader, pmtuBase)
+	makeEncode(info, Resume, timeoutByte(session.idleTimeout)+int(maxV.Main())<<24+int(maxV.Sub())<<16)
+	info[5], info[6] = minV.Main(), minV.Sub()
+	copy(info[7:], session.pathSecret)
+	binary.LittleEndian.PutUint16(info[15:], uint16(len(config.Ticket)))
+	info = append(info, config.Ticket...)
+	//early data has to fit in the first datagram, Write sends the rest
+	room := pmtuBase - len(info)
+	if room < 0 {
+		room = 0
+	}
+	if len(early) > room {
+		early = early[:room]
+	}
+	info = append(info, early...)
+	taken := 0
+	var token []byte
+	code := session.doAndWait(func() {
+		session.sock.WriteTo(info, session.remote)
+	}, sec, func(data []byte) int {
+		status, arg := makeDecode(data)
+		if status == Reset {
+			return 1
+		}
+		if status != ResumeACK || len(data) < 8+resumeTokenSize {
+			return -1
+		}
+		session.id = int(arg)
+		session.version = MakeVersion(data[5], data[6])
+		token = append([]byte(nil), data[8:8+resumeTokenSize]...)
+		session.opts = opts.accept(parseOptions(data[8+resumeTokenSize:]))
+		if data[7] == 1 {
+			taken = len(early)
+		}
+		return 0
+	})
+	if code == 0 {
+		//the listener opens the session when our address echoes its token
+		code = session.doAndWait(func() {
+			session.sock.WriteTo(append(makeEncode(session.encodeBuffer, SndSYN, session.id), token...), session.remote)
+		}, sec, func(data []byte) int {
+			status, arg := makeDecode(data)
+			//the listener may send kcp already, none of that is a Reset or SndACK
+			if len(data) >= int(ikcp.OVERHEAD) {
+				return -1
+			}
+			if status == Reset {
+				return 1
+			}
+			if status != SndACK || int(arg) != session.id {
+				return -1
+			}
+			return 0
+		})
+	}
+	if code != 0 {
+		session.pathSecret = nil
+		return 0, false
+	}
+	session.ticket = config.Ticket
+	return taken, true
+}
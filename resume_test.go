@@ -0,0 +1,178 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func resumeEcho(t *testing.T, lc *ListenConfig) *Listener {
+	l, err := lc.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, 100)
+				n, err := conn.Read(b)
+				if err != nil {
+					return
+				}
+				conn.Write(b[:n])
+			}()
+		}
+	}()
+	return l
+}
+
+func firstTicket(t *testing.T, addr string) []byte {
+	session, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for i := 0; i < 100; i++ {
+		if ticket := session.ResumptionTicket(); ticket != nil {
+			return ticket
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no ticket")
+	return nil
+}
+
+func earlyEcho(t *testing.T, addr string, ticket []byte) *UDPMakeSession {
+	session, err := DialEarly(addr, &Config{Ticket: ticket}, []byte("early"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 100)
+	n, err := session.Read(b)
+	if err != nil || string(b[:n]) != "early" {
+		t.Fatal("bad echo", string(b[:n]), err)
+	}
+	return session
+}
+
+func TestResume(t *testing.T) {
+	l := resumeEcho(t, &ListenConfig{})
+	defer l.Close()
+	ticket := firstTicket(t, l.Addr().String())
+	session := earlyEcho(t, l.Addr().String(), ticket)
+	defer session.Close()
+	resumed := 0
+	l.lock.Lock()
+	for _, s := range l.sessions {
+		if s.resumeAck != nil {
+			resumed++
+		}
+	}
+	l.lock.Unlock()
+	if resumed != 1 || session.Version() != maxVersion {
+		t.Error("not resumed", resumed, session.Version())
+	}
+	//a forged ticket falls back to the full handshake
+	forged := append([]byte(nil), ticket...)
+	forged[len(forged)-1] ^= 1
+	other := earlyEcho(t, l.Addr().String(), forged)
+	other.Close()
+}
+
+func TestResumeWithout0RTT(t *testing.T) {
+	l := resumeEcho(t, &ListenConfig{Config: Config{Disable0RTT: true}})
+	defer l.Close()
+	ticket := firstTicket(t, l.Addr().String())
+	//the listener refuses the early data, the dialer writes it again
+	session := earlyEcho(t, l.Addr().String(), ticket)
+	session.Close()
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	ticket := firstTicket(t, l.Addr().String())
+	<-accepted
+	//a captured Resume sent again from another address
+	resume := make([]byte, resumeHeader)
+	makeEncode(resume, Resume, 30+int(maxVersion.Main())<<24+int(maxVersion.Sub())<<16)
+	resume[5], resume[6] = minVersion.Main(), minVersion.Sub()
+	binary.LittleEndian.PutUint16(resume[15:], uint16(len(ticket)))
+	resume = append(resume, ticket...)
+	resume = append(resume, "early"...)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteTo(resume, l.Addr())
+	b := make([]byte, 2000)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(b)
+	if err != nil || b[0] != ResumeACK || n > len(resume) {
+		t.Fatal("resume answer", n, err)
+	}
+	//without the token echoed nothing is opened
+	select {
+	case <-accepted:
+		t.Fatal("accepted before the round trip")
+	case <-time.After(200 * time.Millisecond):
+	}
+	_, id := makeDecode(b[:n])
+	syn := append(makeEncode(make([]byte, 5), SndSYN, int(id)), b[8:8+resumeTokenSize]...)
+	conn.WriteTo(syn, l.Addr())
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, _, err = conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal("no SndACK", err)
+		}
+		//probes and ResumeACK sent again meanwhile
+		if !isPMTUFrame(b[:n]) && b[0] != ResumeACK {
+			break
+		}
+	}
+	if status, arg := makeDecode(b[:n]); n != 5 || status != SndACK || arg != id {
+		t.Fatal("confirm answer", n, status, arg)
+	}
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not accepted after the round trip")
+	}
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "early" {
+		t.Error("early data", string(b[:n]), err)
+	}
+	//the ticket waits for our kcp
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		n, _, err = conn.ReadFrom(b)
+		if err != nil {
+			break
+		}
+		if !isPMTUFrame(b[:n]) {
+			t.Fatal("listener sent before our kcp", n)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+//go:build (linux && (mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package ukcp
+
+const soReusePort = 0x200
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package ukcp
+
+// syscall does not name SO_REUSEPORT on every linux port
+const soReusePort = 0xf
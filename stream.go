@@ -0,0 +1,52 @@
+package ukcp
+
+import (
+	"encoding/binary"
+	"log"
+)
+
+// from 0.6 on the handshake may put kcp in stream mode: small writes fill
+// up segments and a write is not limited to 255 fragments, but kcp keeps
+// no message boundaries any more, so each message carries its length
+//
+//	[status][payload length uvarint][payload]
+const streamVersion = Version(0)<<8 | 6
+
+// a length beyond this is a broken stream, messages are far smaller
+const streamMessageLimit = 1 << 20
+
+func frameMessage(data []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(data)-1))
+	b := make([]byte, 0, len(data)+n)
+	b = append(b, data[0])
+	b = append(b, l[:n]...)
+	return append(b, data[1:]...)
+}
+
+// streamInput cuts what kcp gave back into messages, the lock must be held
+func (session *UDPMakeSession) streamInput(data []byte) {
+	in := append(session.streamIn, data...)
+	for len(in) > 1 && !session.isQuit() {
+		l, n := binary.Uvarint(in[1:])
+		if n == 0 {
+			break
+		}
+		if n < 0 || l > streamMessageLimit {
+			log.Println("broken stream, reset", session.remote)
+			session.closeOver()
+			return
+		}
+		end := 1 + n + int(l)
+		if len(in) < end {
+			break
+		}
+		session.message(in[0], in[1+n:end])
+		in = in[end:]
+	}
+	if len(in) == 0 {
+		session.streamIn = session.streamIn[:0]
+		return
+	}
+	session.streamIn = append(session.streamIn[:0], in...)
+}
@@ -0,0 +1,111 @@
+package ukcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStreamInput(t *testing.T) {
+	session := &UDPMakeSession{quitChan: make(chan bool)}
+	var wire []byte
+	for _, msg := range []string{"a", "", "hello", string(bytes.Repeat([]byte("x"), 300))} {
+		wire = append(wire, frameMessage(append([]byte{Data}, msg...))...)
+	}
+	//kcp hands the stream out in pieces that ignore the messages
+	for len(wire) > 0 {
+		n := 7
+		if n > len(wire) {
+			n = len(wire)
+		}
+		session.streamInput(wire[:n])
+		wire = wire[n:]
+	}
+	if len(session.rcvQueue) != 4 || string(session.rcvQueue[2]) != "hello" || len(session.rcvQueue[3]) != 300 {
+		t.Errorf("%q", session.rcvQueue)
+	}
+	if len(session.streamIn) != 0 {
+		t.Error("left over", len(session.streamIn))
+	}
+}
+
+func TestStreamMode(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPMakeSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		session := conn.(*UDPMakeSession)
+		accepted <- session
+		go func() {
+			st, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			io.Copy(st, st)
+			st.Close()
+		}()
+		io.Copy(session, session)
+	}()
+	session, err := DialWithConfig(l.Addr().String(), &Config{StreamMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server := <-accepted
+	server.lock.Lock()
+	on := server.streamMode
+	server.lock.Unlock()
+	session.lock.Lock()
+	on = on && session.streamMode
+	session.lock.Unlock()
+	if !on {
+		t.Fatal("stream mode not settled")
+	}
+
+	//many small writes and a stream on the side
+	st, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789"), 20000)
+	done := make(chan error)
+	go func() {
+		st.Write(payload)
+		st.CloseWrite()
+	}()
+	go func() {
+		b, err := ioutil.ReadAll(st)
+		if err == nil && !bytes.Equal(b, payload) {
+			err = io.ErrUnexpectedEOF
+		}
+		done <- err
+	}()
+	var want []byte
+	for i := 0; i < 500; i++ {
+		msg := []byte{byte(i), byte(i >> 8), 'x'}
+		if _, err := session.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, msg...)
+	}
+	session.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(session, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("bad echo")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
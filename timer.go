@@ -0,0 +1,242 @@
+package ukcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// hierarchical timing wheel shared by every session of a listener,
+// a tick only touches the slots that are due, so idle sessions cost nothing
+const (
+	wheelTick   = 10 * time.Millisecond
+	wheelBits   = 8
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 4
+)
+
+type wheelTimer struct {
+	expire     uint64
+	f          func()
+	w          *timerWheel
+	prev, next *wheelTimer
+}
+
+type timerWheel struct {
+	lock     sync.Mutex
+	ticks    uint64
+	clock    ikcp.Clock
+	start    time.Time
+	slots    [wheelLevels][wheelSlots]wheelTimer
+	quitChan chan bool
+	stopOnce sync.Once
+}
+
+func newTimerWheel(clock ikcp.Clock) *timerWheel {
+	w := &timerWheel{clock: clock, start: clock.Now(), quitChan: make(chan bool)}
+	for l := 0; l < wheelLevels; l++ {
+		for s := 0; s < wheelSlots; s++ {
+			head := &w.slots[l][s]
+			head.prev, head.next = head, head
+		}
+	}
+	if clock == ikcp.SystemClock {
+		go w.loop()
+	} else {
+		//another clock calls the wheel back each tick, a fake one on
+		//the goroutine moving it so that its tests see what is due done
+		clock.AfterFunc(wheelTick, w.step)
+	}
+	return w
+}
+
+var systemWheel *timerWheel
+var systemWheelOnce sync.Once
+
+// sessions created by Dial have no listener, on the system clock they share
+// one wheel, on another one each gets a wheel of its own
+func clientWheel(clock ikcp.Clock) *timerWheel {
+	if clock != ikcp.SystemClock {
+		return newTimerWheel(clock)
+	}
+	systemWheelOnce.Do(func() {
+		systemWheel = newTimerWheel(clock)
+	})
+	return systemWheel
+}
+
+// releaseClientWheel stops the wheel of a dialed session that is done with
+// it, the shared one keeps going
+func releaseClientWheel(w *timerWheel) {
+	if w.clock != ikcp.SystemClock {
+		w.stop()
+	}
+}
+
+// now is the time on the clock of the wheel
+func (w *timerWheel) now() time.Time {
+	return w.clock.Now()
+}
+
+func (w *timerWheel) loop() {
+	t := time.NewTicker(wheelTick)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			w.advance(uint64(now.Sub(w.start) / wheelTick))
+		case <-w.quitChan:
+			return
+		}
+	}
+}
+
+func (w *timerWheel) step() {
+	select {
+	case <-w.quitChan:
+		return
+	default:
+	}
+	w.advance(uint64(w.clock.Now().Sub(w.start) / wheelTick))
+	w.clock.AfterFunc(wheelTick, w.step)
+}
+
+// clockTicker is a time.Ticker on any clock, ticks are dropped while C is full
+type clockTicker struct {
+	C        chan time.Time
+	quitChan chan bool
+}
+
+func newClockTicker(clock ikcp.Clock, d time.Duration) *clockTicker {
+	t := &clockTicker{C: make(chan time.Time, 1), quitChan: make(chan bool)}
+	var tick func()
+	tick = func() {
+		select {
+		case <-t.quitChan:
+			return
+		case t.C <- clock.Now():
+		default:
+		}
+		clock.AfterFunc(d, tick)
+	}
+	clock.AfterFunc(d, tick)
+	return t
+}
+
+func (t *clockTicker) stop() {
+	close(t.quitChan)
+}
+
+func (w *timerWheel) stop() {
+	w.stopOnce.Do(func() {
+		close(w.quitChan)
+	})
+}
+
+// newTimer makes a timer that is not scheduled until reset
+func (w *timerWheel) newTimer(f func()) *wheelTimer {
+	return &wheelTimer{f: f, w: w}
+}
+
+// afterFunc calls f on the wheel goroutine once d has elapsed, f must not block
+func (w *timerWheel) afterFunc(d time.Duration, f func()) *wheelTimer {
+	t := w.newTimer(f)
+	w.lock.Lock()
+	w.schedule(t, d)
+	w.lock.Unlock()
+	return t
+}
+
+// reset reschedules t, whether it already fired or not
+func (t *wheelTimer) reset(d time.Duration) {
+	w := t.w
+	w.lock.Lock()
+	t.unlink()
+	w.schedule(t, d)
+	w.lock.Unlock()
+}
+
+// stop reports whether t was still pending
+func (t *wheelTimer) stop() bool {
+	w := t.w
+	w.lock.Lock()
+	pending := t.next != nil
+	t.unlink()
+	w.lock.Unlock()
+	return pending
+}
+
+func (t *wheelTimer) unlink() {
+	if t.next == nil {
+		return
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+}
+
+func (w *timerWheel) schedule(t *wheelTimer, d time.Duration) {
+	n := uint64(0)
+	if d > 0 {
+		n = uint64((d + wheelTick - 1) / wheelTick)
+	}
+	if n == 0 {
+		n = 1
+	}
+	t.expire = w.ticks + n
+	w.insert(t)
+}
+
+func (w *timerWheel) insert(t *wheelTimer) {
+	delta := t.expire - w.ticks
+	level := 0
+	for level < wheelLevels-1 && delta >= uint64(1)<<(uint(level+1)*wheelBits) {
+		level++
+	}
+	if level == wheelLevels-1 {
+		max := uint64(1)<<(uint(wheelLevels)*wheelBits) - 1
+		if delta > max {
+			t.expire = w.ticks + max
+		}
+	}
+	head := &w.slots[level][(t.expire>>(uint(level)*wheelBits))&wheelMask]
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+}
+
+// advance moves the wheel forward to the given tick and runs what expired
+func (w *timerWheel) advance(to uint64) {
+	var due []func()
+	w.lock.Lock()
+	for w.ticks < to {
+		w.ticks++
+		// pull the timers of upper levels down when a lower level wraps
+		for level := 1; level < wheelLevels; level++ {
+			if (w.ticks>>(uint(level-1)*wheelBits))&wheelMask != 0 {
+				break
+			}
+			head := &w.slots[level][(w.ticks>>(uint(level)*wheelBits))&wheelMask]
+			for t := head.next; t != head; {
+				next := t.next
+				t.unlink()
+				w.insert(t)
+				t = next
+			}
+		}
+		head := &w.slots[0][w.ticks&wheelMask]
+		for t := head.next; t != head; {
+			next := t.next
+			t.unlink()
+			due = append(due, t.f)
+			t = next
+		}
+	}
+	w.lock.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
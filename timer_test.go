@@ -0,0 +1,152 @@
+package ukcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+	"github.com/go-ukcp/ukcp/ukcptest"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := newTimerWheel(ikcp.SystemClock)
+	w.stop()
+	fired := map[int]bool{}
+	delays := []int{1, 5, 255, 256, 300, 70000, 20000000}
+	for _, d := range delays {
+		d := d
+		w.afterFunc(time.Duration(d)*wheelTick, func() {
+			fired[d] = true
+		})
+	}
+	stopped := w.afterFunc(10*wheelTick, func() {
+		t.Error("stopped timer fired")
+	})
+	if !stopped.stop() {
+		t.Error("timer should be pending")
+	}
+	for _, d := range delays {
+		w.advance(uint64(d - 1))
+		if fired[d] {
+			t.Errorf("timer %d fired early", d)
+		}
+		w.advance(uint64(d))
+		if !fired[d] {
+			t.Errorf("timer %d did not fire", d)
+		}
+	}
+}
+
+// advanceUntil moves clock a step at a time until done is closed, giving
+// the goroutines woken on the way a moment to run
+func advanceUntil(t *testing.T, clock *ukcptest.FakeClock, step time.Duration, done chan bool) {
+	for i := 0; i < 100000; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		clock.Advance(step)
+		time.Sleep(20 * time.Microsecond)
+	}
+	t.Fatal("still waiting at", clock.Now())
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	clock := ukcptest.NewFakeClock(time.Unix(1000000000, 0))
+	network := ukcptest.NewNetworkClock(1, clock)
+	network.SetDefault(ukcptest.Link{Latency: 20 * time.Millisecond})
+	lconn, _ := network.Listen("server:0")
+	l, err := (&ListenConfig{Config: Config{Clock: clock}}).ListenPacket(lconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+
+	//the handshake retries until the first FirstSYN gets through
+	network.SetLink(ukcptest.Addr("client:1"), l.Addr(), ukcptest.Link{Loss: 1})
+	cconn, _ := network.Listen("client:1")
+	var session *UDPMakeSession
+	done := make(chan bool)
+	go func() {
+		session, err = DialPacket(cconn, l.Addr(), &Config{Clock: clock, DeadLink: 5, RtoPolicy: ikcp.RtoPolicy{Min: 100, Backoff: 2}})
+		close(done)
+	}()
+	clock.Advance(3 * time.Second)
+	network.SetLink(ukcptest.Addr("client:1"), l.Addr(), ukcptest.Link{Latency: 20 * time.Millisecond})
+	advanceUntil(t, clock, 10*time.Millisecond, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	echo := make(chan bool)
+	go func() {
+		defer close(echo)
+		session.Write([]byte("ping"))
+		b := make([]byte, 10)
+		if n, err := session.Read(b); err != nil || string(b[:n]) != "ping" {
+			t.Error("echo", string(b[:n]), err)
+		}
+	}()
+	advanceUntil(t, clock, time.Millisecond, echo)
+
+	//the server is gone, the resends back off until the dead link
+	network.SetDefault(ukcptest.Link{Loss: 1})
+	sent := clock.Now()
+	dead := make(chan bool)
+	go func() {
+		defer close(dead)
+		session.Write([]byte("lost"))
+		if _, err := session.Read(make([]byte, 10)); err != ErrDeadLink {
+			t.Error("read after dead link", err)
+		}
+	}()
+	advanceUntil(t, clock, 10*time.Millisecond, dead)
+	//100, 200, 400 and 800ms apart at least
+	if d := clock.Now().Sub(sent); d < 1500*time.Millisecond || d > 5*time.Second {
+		t.Error("dead link after", d)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error("wall time", d)
+	}
+	//nothing keeps ticking once the session and the listener are gone
+	l.Close()
+	clock.Advance(time.Second)
+	if n := clock.Pending(); n != 0 {
+		t.Error("timers left", n)
+	}
+}
+
+// a clock that cannot be a map key
+type sliceClock struct {
+	ikcp.Clock
+	marks []int
+}
+
+func TestClientWheel(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+	session, err := DialWithConfig(l.Addr().String(), &Config{Clock: sliceClock{Clock: ikcp.SystemClock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Write([]byte("ping"))
+	b := make([]byte, 10)
+	session.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := session.Read(b); err != nil || string(b[:n]) != "ping" {
+		t.Error("echo", string(b[:n]), err)
+	}
+	session.Close()
+	select {
+	case <-session.wheel.quitChan:
+	default:
+		t.Error("wheel of a closed session still running")
+	}
+}
@@ -1,10 +1,15 @@
 package ukcp
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"io"
 	"log"
+	"math"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/go-ukcp/ukcp/ikcp"
@@ -15,21 +20,20 @@ const ReadBufferSize = 7000  //so reader must be larger
 
 const dataLimit = 4000
 
-const mainV = 0
-const subV = 1
+// messages drained out of kcp and kept for Read
+const recvQueueLimit = 128
 
-type cache struct {
-	b []byte
-	l int
-	c chan int
-}
+// handshakes waiting for Accept before new ones are reset
+const acceptBacklog = 128
 
-func init() {
-}
+const keepAliveInterval = 1200 * time.Millisecond
+const handshakeInterval = 50 * time.Millisecond
+const closeWait = 500 * time.Millisecond
+
+const mainV = 0
+const subV = 6
 
-type Action struct {
-	t    string
-	args []interface{}
+func init() {
 }
 
 type _reuseTbl struct {
@@ -38,8 +42,11 @@ type _reuseTbl struct {
 
 var currIdMap map[string]int
 var reuseTbl map[string]*_reuseTbl
+var idLock sync.Mutex
 
 func GetId(name string) int {
+	idLock.Lock()
+	defer idLock.Unlock()
 	if reuseTbl != nil {
 		tbl, bHave := reuseTbl[name]
 		if bHave {
@@ -63,6 +70,8 @@ func GetId(name string) int {
 
 func RmId(name string, id int) {
 	return
+	idLock.Lock()
+	defer idLock.Unlock()
 	if currIdMap == nil {
 		currIdMap = make(map[string]int)
 		currIdMap[name] = 0
@@ -82,10 +91,6 @@ func RmId(name string, id int) {
 	//	println("can reuse ", name, id)
 }
 
-func iclock() int32 {
-	return int32((time.Now().UnixNano() / 1000000) & 0xffffffff)
-}
-
 func udp_output(buf []byte, _len int32, kcp *ikcp.Ikcpcb, user interface{}) int32 {
 	c := user.(*UDPMakeSession)
 	//log.Println("send udp", _len, c.remote.String())
@@ -94,18 +99,33 @@ func udp_output(buf []byte, _len int32, kcp *ikcp.Ikcpcb, user interface{}) int3
 }
 
 const (
-	Reset     byte = 0
-	FirstSYN  byte = 6
-	FirstACK  byte = 1
-	SndSYN    byte = 2
-	SndACK    byte = 2
-	Data      byte = 4
-	Ping      byte = 5
-	Close     byte = 7
-	CloseBack byte = 8
-	ResetAck  byte = 9
+	Reset       byte = 0
+	FirstSYN    byte = 6
+	FirstACK    byte = 1
+	SndSYN      byte = 2
+	SndACK      byte = 2
+	Data        byte = 4
+	Ping        byte = 5
+	Close       byte = 7
+	CloseBack   byte = 8
+	ResetAck    byte = 9
+	StreamFrame byte = 10
+	Fin         byte = 14
+	Ticket      byte = 17
+	Resume      byte = 18
+	ResumeACK   byte = 19
+	// DatagramFrame, PathChallenge, PathResponse, PMTUProbe and PMTUAck
+	// go after the conv, not first like the others
+	DatagramFrame byte = 11
+	PathChallenge byte = 12
+	PathResponse  byte = 13
+	PMTUProbe     byte = 15
+	PMTUAck       byte = 16
 )
 
+// a peer that only speaks 0.1 knows neither StreamFrame, DatagramFrame nor Fin
+const framesVersion = Version(0)<<8 | 2
+
 func makeEncode(buf []byte, status byte, arg int) []byte {
 	buf[0] = status
 	binary.LittleEndian.PutUint32(buf[1:], uint32(arg))
@@ -121,37 +141,104 @@ func makeDecode(data []byte) (status byte, arg int32) {
 	return
 }
 
+var errClosed = errors.New("closed")
+var errReadQuit = errors.New("force quit for read error")
+var errWriteClosed = errors.New("write after CloseWrite")
+var errOldVersion = errors.New("the peer's version is too old for this")
+
+var processBufferPool = sync.Pool{New: func() interface{} { return make([]byte, ReadBufferSize) }}
+
+// UDPMakeSession is a state machine, it has no goroutine of its own:
+// the read loop of its socket feeds input and the timer wheel drives
+// updates, keepalive and close, Read and Write only take the lock
 type UDPMakeSession struct {
-	id                int
-	idstr             string
-	status            string
-	overTime          int64
-	quitChan          chan bool
-	closeChan         chan bool
-	recvChan          chan cache
-	handShakeChan     chan string
-	handShakeChanQuit chan bool
-	sock              *net.UDPConn
-	remote            *net.UDPAddr
-	kcp               *ikcp.Ikcpcb
-	do                chan Action
-	do2               chan Action
-	checkCanWrite     chan (chan bool)
-	listener          *Listener
-	closed            bool
-
-	readBuffer    []byte
-	processBuffer []byte
-	encodeBuffer  []byte
-	timeout       int64
+	lock     sync.Mutex
+	id       int
+	status   string
+	version  Version
+	opts     *kcpOptions //settled in the handshake, applied by start
+	lastRecv int64       //unix nano
+	lastPing int64
+	quitChan chan bool
+	sock     net.PacketConn
+	remote   net.Addr
+	kcp      *ikcp.Ikcpcb
+	listener *Listener
+	shard    *listenShard
+	wheel    *timerWheel
+	closed   bool
+
+	updating       bool
+	updateTimer    *wheelTimer
+	pingTimer      *wheelTimer
+	handshakeTimer *wheelTimer
+	closeTimer     *wheelTimer
+
+	rcvQueue      [][]byte
+	readWake      chan bool
+	readWaiting   int
+	writeWake     chan bool
+	writeWaiting  int
+	readDeadline  time.Time
+	writeDeadline time.Time
+	finSent       bool //CloseWrite was called
+	finRecv       bool //the peer called CloseWrite
+	readClosed    bool
+	readPaused    bool //kcp is not drained, its window closes
+	mux           *mux
+	datagrams     *datagrams
+	pmtud         *pmtud
+	ticket        []byte      //dialer: to resume next time
+	streamMode    bool        //kcp in stream mode, messages carry their length
+	streamIn      []byte      //what came of a message that is not complete yet
+	resumeAck     []byte      //listener: sent again when Resume is
+	resumeToken   []byte      //listener: the dialer echoes it in SndSYN to open a resumed session
+	ticketOpts    *kcpOptions //listener: the ticket waits for the dialer's first kcp packet
+	pathSecret    []byte
+	pathProbe     *pathProbe
+
+	readBuffer   []byte
+	encodeBuffer []byte
+	keepAlive    time.Duration
+	idleTimeout  time.Duration
+	onIdle       func(*UDPMakeSession)
+	deadLink     int  //kcp's, 0 for its default
+	pingsOnly    bool //only keepalive Pings wait for an ack, kcp's dead link is off
+	ackPolicy    ikcp.AckPolicy
+	rtoPolicy    ikcp.RtoPolicy
+	closeErr     error //why Read and Write fail once it is closed, if not the usual
 }
 
 type Listener struct {
 	connChan   chan *UDPMakeSession
 	quitChan   chan bool
-	sock       *net.UDPConn
+	shards     []*listenShard
+	wheel      *timerWheel
+	closed     bool
+	lock       sync.Mutex
+	sessions   map[uint32]*UDPMakeSession //by conv, a session may change address
+	shutting   bool                       //Shutdown refuses new handshakes
+	config     Config
+	ticketAEAD cipher.AEAD
+	rcvMemory  *ikcp.RcvMemory //shared by the autotuned sessions, nil without a cap
+}
+
+// one socket of the listener, with its own read loop and address table
+type listenShard struct {
+	listener   *Listener
+	sock       net.PacketConn
 	readBuffer []byte
-	sessions   map[string]*UDPMakeSession
+	lock       sync.Mutex
+	addrs      map[string]*UDPMakeSession
+}
+
+func newSession(sock net.PacketConn, remote net.Addr, wheel *timerWheel) *UDPMakeSession {
+	session := &UDPMakeSession{sock: sock, remote: remote, wheel: wheel, quitChan: make(chan bool), readWake: make(chan bool), writeWake: make(chan bool), encodeBuffer: make([]byte, 5), keepAlive: keepAliveInterval, idleTimeout: defaultIdleTimeout}
+	session.updateTimer = wheel.newTimer(session.onUpdate)
+	session.pingTimer = wheel.newTimer(session.onPing)
+	session.handshakeTimer = wheel.newTimer(session.onHandshake)
+	session.closeTimer = wheel.newTimer(session.closeOverLocked)
+	return session
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
@@ -168,49 +255,26 @@ func (l *Listener) Accept() (net.Conn, error) {
 }
 
 func (l *Listener) Dump() {
-	for addr, session := range l.sessions {
-		log.Println("listener", addr, session.status)
+	for i, sh := range l.shards {
+		sh.lock.Lock()
+		for addr, session := range sh.addrs {
+			log.Println("listener", i, addr, session.id, session.status)
+		}
+		sh.lock.Unlock()
 	}
 }
 
-func (l *Listener) inner_loop() {
-	sock := l.sock
+func (sh *listenShard) inner_loop() {
+	sock := sh.sock
 	for {
-		n, from, err := sock.ReadFromUDP(l.readBuffer)
+		n, from, err := sock.ReadFrom(sh.readBuffer)
 		if err == nil {
 			//log.Println("recv", n, from)
-			addr := from.String()
-			session, bHave := l.sessions[addr]
-			if bHave {
-				if session.status == "ok" {
-					if session.remote.String() == from.String() && n >= int(ikcp.OVERHEAD) {
-						buf := make([]byte, n)
-						copy(buf, l.readBuffer[:n])
-						session.DoAction2("input", buf, n)
-					}
-					continue
-				} else {
-					session.serverDo(string(l.readBuffer[:n]))
-				}
-			} else {
-				status, _ := makeDecode(l.readBuffer[:n])
-				if status != FirstSYN {
-					go sock.WriteToUDP([]byte("0"), from)
-					log.Println("invalid package,reset", from, status)
-					continue
-				}
-				sessionId := GetId("udp")
-				session = &UDPMakeSession{status: "init", overTime: time.Now().Unix() + 10, remote: from, sock: sock, recvChan: make(chan cache), quitChan: make(chan bool), readBuffer: make([]byte, ReadBufferSize), processBuffer: make([]byte, ReadBufferSize), timeout: 30, do: make(chan Action), do2: make(chan Action), id: sessionId, handShakeChan: make(chan string), handShakeChanQuit: make(chan bool), listener: l, closeChan: make(chan bool), encodeBuffer: make([]byte, 5), checkCanWrite: make(chan (chan bool))}
-				l.sessions[addr] = session
-				session.serverInit(l)
-				session.serverDo(string(l.readBuffer[:n]))
-			}
-			//log.Println("debug out.........")
+			sh.dispatch(sh.readBuffer[:n], from)
 		} else {
 			e, ok := err.(net.Error)
 			if !ok || !e.Timeout() {
 				log.Println("recv error", err.Error(), from)
-				l.remove(from.String())
 				//time.Sleep(time.Second)
 				break
 			}
@@ -218,47 +282,117 @@ func (l *Listener) inner_loop() {
 	}
 }
 
-func (l *Listener) remove(addr string) {
+func (sh *listenShard) dispatch(data []byte, from net.Addr) {
+	addr := from.String()
+	l := sh.listener
+	sh.lock.Lock()
+	session, bHave := sh.addrs[addr]
+	sh.lock.Unlock()
+	if !bHave {
+		//a known session talking from a new address
+		if conv, ok := sessionConv(data); ok {
+			l.lock.Lock()
+			session = l.sessions[conv]
+			l.lock.Unlock()
+			if session != nil && session.migrateInput(data, from, sh) {
+				return
+			}
+		}
+		status, _ := makeDecode(data)
+		if (status != FirstSYN && !isResume(data)) || l.isShutting() {
+			sh.sock.WriteTo([]byte("0"), from)
+			log.Println("invalid package,reset", from, status)
+			return
+		}
+		session = newSession(sh.sock, from, l.wheel)
+		session.status = "init"
+		session.lastRecv = session.wheel.now().UnixNano()
+		session.idleTimeout = 10 * time.Second
+		session.id = GetId("udp")
+		session.listener = l
+		session.shard = sh
+		sh.lock.Lock()
+		if other, bHave := sh.addrs[addr]; bHave {
+			session = other
+		} else {
+			l.lock.Lock()
+			if l.shutting || l.closed {
+				//Shutdown or Close took its snapshot meanwhile
+				l.lock.Unlock()
+				sh.lock.Unlock()
+				sh.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), from)
+				return
+			}
+			sh.addrs[addr] = session
+			l.sessions[uint32(session.id)] = session
+			l.lock.Unlock()
+		}
+		sh.lock.Unlock()
+	}
+	session.serverInput(data)
+}
+
+func (sh *listenShard) remove(session *UDPMakeSession) {
+	addr := session.remote.String()
 	log.Println("listener remove", addr)
-	session, bHave := l.sessions[addr]
-	if bHave {
+	sh.lock.Lock()
+	if sh.addrs[addr] == session {
+		delete(sh.addrs, addr)
+	}
+	sh.lock.Unlock()
+	l := sh.listener
+	l.lock.Lock()
+	if l.sessions[uint32(session.id)] == session {
+		delete(l.sessions, uint32(session.id))
 		RmId("udp", session.id)
 	}
-	delete(l.sessions, addr)
+	l.lock.Unlock()
 }
 
 func (l *Listener) Close() error {
-	if l.sock != nil {
-		l.sock.Close()
-		l.sock = nil
-	} else {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
 		return nil
 	}
+	l.closed = true
+	sessions := make([]*UDPMakeSession, 0, len(l.sessions))
+	for _, session := range l.sessions {
+		sessions = append(sessions, session)
+	}
+	l.lock.Unlock()
+	//the sessions run on the wheel, they end before it stops, the peers
+	//hear nothing like before
+	for _, session := range sessions {
+		session.lock.Lock()
+		session.closeOver()
+		session.lock.Unlock()
+	}
+	for _, sh := range l.shards {
+		sh.sock.Close()
+	}
+	l.wheel.stop()
 	close(l.quitChan)
 	return nil
 }
 
 func (l *Listener) Addr() net.Addr {
-	return nil
+	return l.shards[0].sock.LocalAddr()
 }
 
 func (l *Listener) loop() {
-	l.inner_loop()
+	for _, sh := range l.shards {
+		go sh.inner_loop()
+	}
 }
 
 func Listen(addr string) (*Listener, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
-	sock, _err := net.ListenUDP("udp", udpAddr)
-	if _err != nil {
-		return nil, _err
-	}
+	return (&ListenConfig{}).Listen(addr)
+}
 
-	listener := &Listener{connChan: make(chan *UDPMakeSession), quitChan: make(chan bool), sock: sock, readBuffer: make([]byte, ReadBufferSize), sessions: make(map[string]*UDPMakeSession)}
-	go listener.loop()
-	return listener, nil
+// ListenPacket serves sessions over conn, see ListenConfig.ListenPacket
+func ListenPacket(conn net.PacketConn) (*Listener, error) {
+	return (&ListenConfig{}).ListenPacket(conn)
 }
 
 func Dial(addr string) (*UDPMakeSession, error) {
@@ -277,6 +411,29 @@ func DialTimeout(addr string, timeout int) (*UDPMakeSession, error) {
 	if bReset {
 		log.Println("timeout should in [5, 255], force reset timeout to", timeout)
 	}
+	return DialWithConfig(addr, &Config{IdleTimeout: time.Duration(timeout) * time.Second})
+}
+
+// DialWithConfig dials with the settings of config, nil means the defaults
+func DialWithConfig(addr string, config *Config) (*UDPMakeSession, error) {
+	return dial(addr, config, nil)
+}
+
+// DialEarly resumes with config.Ticket and sends early in the first
+// datagram, what does not fit there or what the listener refused is written
+// once the session is up. See resume.go about replays
+func DialEarly(addr string, config *Config, early []byte) (*UDPMakeSession, error) {
+	return dial(addr, config, early)
+}
+
+// DialPacket dials addr over conn instead of a socket of its own, as over
+// the in-memory network of ukcptest. The session owns conn from then on,
+// it is closed with the session or when the handshake fails
+func DialPacket(conn net.PacketConn, addr net.Addr, config *Config) (*UDPMakeSession, error) {
+	return dialPacket(conn, addr, config, nil)
+}
+
+func dial(addr string, config *Config, early []byte) (*UDPMakeSession, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, err
@@ -286,23 +443,53 @@ func DialTimeout(addr string, timeout int) (*UDPMakeSession, error) {
 		log.Println("dial addr fail", _err.Error())
 		return nil, _err
 	}
-	session := &UDPMakeSession{readBuffer: make([]byte, ReadBufferSize), do: make(chan Action), do2: make(chan Action), quitChan: make(chan bool), recvChan: make(chan cache), processBuffer: make([]byte, ReadBufferSize), closeChan: make(chan bool), encodeBuffer: make([]byte, 5), checkCanWrite: make(chan (chan bool))}
-	session.remote = udpAddr
-	session.sock = sock
+	return dialPacket(sock, udpAddr, config, early)
+}
+
+func dialPacket(sock net.PacketConn, udpAddr net.Addr, config *Config, early []byte) (*UDPMakeSession, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	session := newSession(sock, udpAddr, clientWheel(config.clock()))
+	session.readBuffer = make([]byte, ReadBufferSize)
 	session.status = "firstsyn"
-	session.timeout = int64(timeout)
+	config.apply(session)
+	timeout := timeoutByte(session.idleTimeout)
 	_timeout := int(timeout / 2)
 	if _timeout < 5 {
-		timeout = 5
+		_timeout = 5
+	}
+	if config.Ticket != nil {
+		if taken, ok := session.dialResume(config, early, _timeout); ok {
+			return session.established(early[taken:])
+		}
+		log.Println("resume fail, full handshake", udpAddr)
+	}
+	minV, maxV := config.versions()
+	opts := config.kcpOptions()
+	firstSYN := func(max Version) []byte {
+		info := make([]byte, 7, 32)
+		makeEncode(info, FirstSYN, int(int32(timeout)+int32(max.Main())<<24+int32(max.Sub())<<16))
+		info[5], info[6] = minV.Main(), minV.Sub()
+		return opts.encode(info)
 	}
-	arg := int(int32(timeout) + int32(mainV<<24) + int32(subV<<16))
-	info := makeEncode(session.encodeBuffer, FirstSYN, arg)
+	want := maxV
+	info := firstSYN(want)
 	code := session.doAndWait(func() {
-		sock.WriteToUDP(info, udpAddr)
-	}, _timeout, func(status byte, arg int32) int {
+		sock.WriteTo(info, udpAddr)
+	}, _timeout, func(data []byte) int {
+		status, arg := makeDecode(data)
 		if status == ResetAck {
-			_mainV, _subV := int(byte(arg>>24)), int(byte(arg>>16))
-			log.Printf("pipe version not eq,%d.%d=>%d.%d", mainV, subV, _mainV, _subV)
+			v := MakeVersion(byte(arg>>24), byte(arg>>16))
+			//a listener without ranges only looks at our highest, ask
+			//again with its own when we speak it
+			if v >= minV && v < want {
+				log.Printf("pipe version downgrade,%s-%s=>%s", minV, maxV, v)
+				want = v
+				info = firstSYN(want)
+				return -1
+			}
+			log.Printf("pipe version not supported,%s-%s=>%s", minV, maxV, v)
 			return 1
 		}
 		if status != FirstACK {
@@ -310,49 +497,80 @@ func DialTimeout(addr string, timeout int) (*UDPMakeSession, error) {
 		} else {
 			session.status = "firstack"
 			session.id = int(arg)
+			//a listener without ranges only took our highest
+			session.version = want
+			session.opts = opts
+			if len(data) >= 7 {
+				session.version = MakeVersion(data[5], data[6])
+				if session.version >= optionsVersion {
+					session.opts = opts.accept(parseOptions(data[7:]))
+				}
+			}
 			return 0
 		}
 	})
 	if code != 0 {
+		sock.Close()
+		releaseClientWheel(session.wheel)
 		return nil, errors.New("handshake fail,1")
 	}
+	//lets the server tell us from a stranger once our address changes
+	session.pathSecret = newPathSecret()
 	code = session.doAndWait(func() {
-		sock.WriteToUDP(makeEncode(session.encodeBuffer, SndSYN, session.id), udpAddr)
-	}, _timeout, func(status byte, arg int32) int {
-		if status != SndACK {
+		sock.WriteTo(append(makeEncode(session.encodeBuffer, SndSYN, session.id), session.pathSecret...), udpAddr)
+	}, _timeout, func(data []byte) int {
+		status, arg := makeDecode(data)
+		//kcp of the listener is not our answer, an app may write at once
+		if status != SndACK || len(data) >= int(ikcp.OVERHEAD) {
 			return -1
 		} else if session.id != int(arg) {
 			return 2
 		} else {
-			session.status = "ok"
 			return 0
 		}
 	})
 	if code != 0 {
+		sock.Close()
+		releaseClientWheel(session.wheel)
 		return nil, errors.New("handshake fail,2")
 	}
-	session.kcp = ikcp.Create(uint32(session.id), session)
-	session.kcp.Output = udp_output
-	session.kcp.Wndsize(128, 128)
-	session.kcp.Nodelay(1, 10, 2, 1)
-	go session.loop()
+	return session.established(early)
+}
+
+// established starts a dialed session and writes what early data is left
+func (session *UDPMakeSession) established(early []byte) (*UDPMakeSession, error) {
+	session.lock.Lock()
+	session.start()
+	if session.version >= resumeVersion {
+		//the listener sends the ticket once it hears kcp from us
+		session.sendFrame(Ping)
+	}
+	session.lock.Unlock()
+	go session.clientLoop()
+	if len(early) > 0 {
+		if _, err := session.Write(early); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
 	return session, nil
 }
 
-func (session *UDPMakeSession) doAndWait(f func(), sec int, readf func(status byte, arg int32) int) (code int) {
-	t := time.NewTicker(50 * time.Millisecond)
-	currT := time.Now().Unix()
+func (session *UDPMakeSession) doAndWait(f func(), sec int, readf func(data []byte) int) (code int) {
+	clock := session.wheel.clock
+	t := newClockTicker(clock, 50*time.Millisecond)
+	currT := clock.Now()
 	f()
 out:
 	for {
 		select {
 		case <-t.C:
-			if time.Now().Unix()-currT >= int64(sec) {
+			if clock.Now().Sub(currT) >= time.Duration(sec)*time.Second {
 				code = -1
 				break out
 			}
-			session.sock.SetReadDeadline(time.Now().Add(2 * time.Second))
-			n, from, err := session.sock.ReadFromUDP(session.readBuffer)
+			session.sock.SetReadDeadline(clock.Now().Add(2 * time.Second))
+			n, from, err := session.sock.ReadFrom(session.readBuffer)
 			if err != nil {
 				e, ok := err.(net.Error)
 				if !ok || !e.Timeout() {
@@ -361,408 +579,594 @@ out:
 					break out
 				}
 			} else {
-				code = readf(makeDecode(session.readBuffer[:n]))
+				code = readf(session.readBuffer[:n])
 				if code >= 0 {
 					break out
 				}
 			}
-			go f()
+			f()
 		}
 	}
-	t.Stop()
+	t.stop()
 	if code > 0 {
 		log.Println("handshake fail,got code", code)
 	}
 	return
 }
 
-func (session *UDPMakeSession) serverDo(s string) {
-	go func() {
-		//log.Println("prepare handshake", session.remote)
-		select {
-		case <-session.handShakeChanQuit:
-		case session.handShakeChan <- s:
-		}
-	}()
-}
-func (session *UDPMakeSession) serverInit(l *Listener) {
-	go func() {
-		c := time.NewTicker(50 * time.Millisecond)
-		defer func() {
-			close(session.handShakeChanQuit)
-			c.Stop()
-			if session.status != "ok" {
-				session.Close()
-			}
-		}()
-		overTime := time.Now().Unix() + session.timeout
-		for {
-			select {
-			case s := <-session.handShakeChan:
-				//log.Println("process handshake", session.remote)
-				status, arg := makeDecode([]byte(s))
-				switch session.status {
-				case "init":
-					if status != FirstSYN {
-						session.sock.WriteToUDP(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
-						return
-					}
-					_mainV, _subV := int(byte(arg>>24)), int(byte(arg>>16))
-					if _mainV != mainV || _subV != subV {
-						session.sock.WriteToUDP(makeEncode(session.encodeBuffer, ResetAck, (mainV<<24)+(subV<<16)), session.remote)
-						log.Printf("pipe version not eq,kickout,%d.%d=>%d.%d", mainV, subV, _mainV, _subV)
-						return
-					}
-					session.status = "firstack"
-					session.timeout = int64(arg & 0xff)
-					session.sock.WriteToUDP(makeEncode(session.encodeBuffer, FirstACK, session.id), session.remote)
-					overTime = time.Now().Unix() + session.timeout
-				case "firstack":
-					if status != SndSYN {
-						return
-					}
-					session.status = "ok"
-					session.kcp = ikcp.Create(uint32(session.id), session)
-					session.kcp.Output = udp_output
-					session.kcp.Wndsize(128, 128)
-					session.kcp.Nodelay(1, 10, 2, 1)
-					go session.loop()
-					go func() {
-						select {
-						case l.connChan <- session:
-						case <-l.quitChan:
-						}
-					}()
-					session.sock.WriteToUDP(makeEncode(session.encodeBuffer, SndACK, session.id), session.remote)
-					overTime = time.Now().Unix() + session.timeout
-				}
-			case <-c.C:
-				if time.Now().Unix() > overTime {
-					return
-				}
-				switch session.status {
-				case "firstack":
-					session.sock.WriteToUDP(makeEncode(session.encodeBuffer, FirstACK, session.id), session.remote)
-				case "ok":
-					buf := make([]byte, 5)
-					session.sock.WriteToUDP(makeEncode(buf, SndACK, session.id), session.remote)
+// the only goroutine of a dialed session, the server side shares the shard read loop
+func (session *UDPMakeSession) clientLoop() {
+	tmp := session.readBuffer
+	//Rebind may run as soon as the dial returns
+	session.lock.Lock()
+	sock := session.sock
+	session.lock.Unlock()
+	sock.SetReadDeadline(time.Time{})
+	for {
+		n, from, err := sock.ReadFrom(tmp)
+		if err != nil {
+			e, ok := err.(net.Error)
+			if !ok || !e.Timeout() {
+				//Rebind swapped the socket under us
+				session.lock.Lock()
+				next := session.sock
+				session.lock.Unlock()
+				if next == sock || session.isQuit() {
+					break
 				}
+				sock = next
 			}
+			continue
 		}
-	}()
-}
-
-func (session *UDPMakeSession) loop() {
-	curr := time.Now().Unix()
-	session.overTime = curr + session.timeout
-	ping := make(chan bool)
-	pingC := 0
-	callUpdate := false
-	updateC := make(chan bool)
-	if session.listener == nil {
-		go func() {
-			tmp := session.readBuffer
-			t := time.Time{}
-			session.sock.SetReadDeadline(t)
-			for {
-				n, from, err := session.sock.ReadFromUDP(tmp)
-				if err != nil {
-					e, ok := err.(net.Error)
-					if !ok || !e.Timeout() {
-						break
-					}
-				}
-				if session.remote.String() == from.String() {
-					if n >= int(ikcp.OVERHEAD) || n <= 5 {
-						buf := make([]byte, n)
-						copy(buf, session.readBuffer[:n])
-						session.DoAction2("input", buf, n)
-					}
-				}
+		if session.remote.String() == from.String() {
+			session.lock.Lock()
+			session.input(tmp[:n])
+			session.lock.Unlock()
+		}
+	}
+	session.closeOverLocked()
+}
+
+// start the established session, the lock must be held
+func (session *UDPMakeSession) start() {
+	session.status = "ok"
+	session.kcp = ikcp.Create(uint32(session.id), session)
+	session.kcp.Output = udp_output
+	if session.opts == nil {
+		session.opts = (&Config{}).kcpOptions()
+	}
+	if session.version < streamVersion {
+		session.opts.stream = false
+	}
+	session.streamMode = session.opts.stream
+	session.kcp.SetAckPolicy(session.ackPolicy)
+	session.opts.apply(session.kcp)
+	session.kcp.SetSack(session.version >= sackVersion)
+	session.kcp.SetDeadLink(int32(session.deadLink))
+	session.kcp.SetRtoPolicy(session.rtoPolicy)
+	if session.opts.rcvMax > 0 {
+		var mem *ikcp.RcvMemory
+		if session.listener != nil {
+			mem = session.listener.rcvMemory
+		}
+		session.kcp.SetAutoTune(int32(session.opts.rcvMax), mem)
+	}
+	if session.listener != nil && session.version >= resumeVersion {
+		session.ticketOpts = session.opts
+	}
+	if session.pmtud != nil {
+		//discovery does not go past what the handshake settled on
+		session.pmtud.limit = session.opts.mtu
+	}
+	session.opts = nil
+	if session.pmtud != nil && session.version >= pmtuVersion {
+		session.pmtuStart()
+	}
+	now := session.wheel.now().UnixNano()
+	session.lastRecv = now
+	session.lastPing = now
+	session.pingTimer.reset(session.nextPing(now))
+}
+
+func (session *UDPMakeSession) serverInput(data []byte) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isQuit() {
+		return
+	}
+	if session.status == "ok" {
+		session.input(data)
+		return
+	}
+	//log.Println("process handshake", session.remote)
+	status, arg := makeDecode(data)
+	switch session.status {
+	case "init":
+		if isResume(data) {
+			session.serverResume(data)
+			return
+		}
+		if status != FirstSYN {
+			session.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
+			session.closeOver()
+			return
+		}
+		minV, maxV := session.listener.config.versions()
+		peerMin, peerMax := peerVersions(data)
+		v, ok := pickVersion(minV, maxV, peerMin, peerMax)
+		if !ok {
+			session.sock.WriteTo(makeEncode(session.encodeBuffer, ResetAck, int(maxV.Main())<<24+int(maxV.Sub())<<16), session.remote)
+			log.Printf("pipe version not supported,kickout,%s-%s=>%s-%s", minV, maxV, peerMin, peerMax)
+			session.closeOver()
+			return
+		}
+		session.version = v
+		session.opts = session.listener.config.kcpOptions()
+		if v >= optionsVersion && len(data) > 7 {
+			session.opts = session.opts.settle(parseOptions(data[7:]))
+		}
+		session.status = "firstack"
+		session.idleTimeout = time.Duration(arg&0xff) * time.Second
+		session.listener.config.apply(session)
+		session.sendFirstACK()
+		session.lastRecv = session.wheel.now().UnixNano()
+		session.handshakeTimer.reset(handshakeInterval)
+	case "firstack":
+		if status == FirstSYN {
+			session.sendFirstACK()
+			return
+		}
+		if status != SndSYN {
+			session.closeOver()
+			return
+		}
+		if len(data) >= 5+pathSecretSize {
+			session.pathSecret = append([]byte(nil), data[5:5+pathSecretSize]...)
+		}
+		session.handshakeTimer.stop()
+		select {
+		case session.listener.connChan <- session:
+		default:
+			log.Println("accept backlog full,reset", session.remote)
+			session.sock.WriteTo(makeEncode(session.encodeBuffer, Reset, 0), session.remote)
+			session.closeOver()
+			return
+		}
+		session.start()
+		session.sock.WriteTo(makeEncode(session.encodeBuffer, SndACK, session.id), session.remote)
+	case "resumeack":
+		session.resumeConfirm(data)
+	}
+}
+
+func (session *UDPMakeSession) onHandshake() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if (session.status != "firstack" && session.status != "resumeack") || session.isQuit() {
+		return
+	}
+	if session.wheel.now().UnixNano()-session.lastRecv > int64(session.idleTimeout) {
+		session.closeOver()
+		return
+	}
+	if session.status == "resumeack" {
+		session.sock.WriteTo(session.resumeAck, session.remote)
+	} else {
+		session.sendFirstACK()
+	}
+	session.handshakeTimer.reset(handshakeInterval)
+}
+
+// input handles a datagram of an established session, the lock must be held
+func (session *UDPMakeSession) input(data []byte) {
+	if session.isQuit() {
+		return
+	}
+	n := len(data)
+	session.lastRecv = session.wheel.now().UnixNano()
+	if session.resumeAck != nil && isResume(data) {
+		//our ResumeACK was lost
+		session.sock.WriteTo(session.resumeAck, session.remote)
+		return
+	}
+	if n < 5 {
+		log.Println("recv reset")
+		session.closeOver()
+		return
+	} else if isDatagram(data) {
+		session.datagramInput(data)
+		return
+	} else if isPathFrame(data) {
+		session.pathInput(data)
+		return
+	} else if isPMTUFrame(data) {
+		session.pmtuInput(data)
+		return
+	} else if n < int(ikcp.OVERHEAD) {
+		status, arg := makeDecode(data)
+		switch status {
+		case Reset, ResetAck:
+			log.Println("recv reset2", status)
+			session.closeOver()
+		case SndSYN:
+			//our SndACK was lost, the client is still shaking hands
+			if session.shard != nil && int(arg) == session.id {
+				session.sock.WriteTo(makeEncode(session.encodeBuffer, SndACK, session.id), session.remote)
 			}
-		}()
-	}
-	updateF := func(n time.Duration) {
-		if !callUpdate {
-			callUpdate = true
-			time.AfterFunc(n*time.Millisecond, func() {
-				select {
-				case updateC <- true:
-				case <-session.quitChan:
-				}
-			})
-		}
-	}
-
-	fastCheck := false
-	waitList := [](chan bool){}
-	recoverChan := make(chan bool)
-
-	var waitRecvCache *cache
-	go func() {
-	out:
-		for {
-			select {
-			//session.wait.Done()
-			case <-ping:
-				updateF(50)
-				pingC++
-				if pingC >= 4 {
-					pingC = 0
-					if session.kcp.Waitsnd() <= dataLimit/2 {
-						go session.DoWrite(makeEncode(session.encodeBuffer, Ping, 0))
-					}
-				}
-				if time.Now().Unix() > session.overTime {
-					log.Println("overtime close", session.LocalAddr().String(), session.RemoteAddr().String())
-					go session.Close()
-				} else {
-					time.AfterFunc(300*time.Millisecond, func() {
-						select {
-						case ping <- true:
-						case <-session.quitChan:
-						}
-					})
-				}
-			case <-recoverChan:
-				fastCheck = false
-				for _, r := range waitList {
-					log.Println("recover writing data")
-					select {
-					case r <- true:
-					case <-session.quitChan:
-					}
-				}
-				waitList = [](chan bool){}
-			case c := <-session.checkCanWrite:
-				if session.kcp.Waitsnd() > dataLimit {
-					log.Println("wait for data limit")
-					waitList = append(waitList, c)
-					if !fastCheck {
-						fastCheck = true
-						var f func()
-						f = func() {
-							n := session.kcp.Waitsnd()
-							//log.Println("fast check!", n, len(waitList))
-							if n <= dataLimit/2 {
-								select {
-								case <-session.quitChan:
-								case recoverChan <- true:
-								}
-							} else {
-								updateF(20)
-								time.AfterFunc(40*time.Millisecond, f)
-							}
-						}
-						time.AfterFunc(20*time.Millisecond, f)
-					}
-				} else {
-					select {
-					case c <- true:
-					case <-session.quitChan:
-					}
-				}
-			case ca := <-session.recvChan:
-				tmp := session.processBuffer
-				for {
-					hr := session.kcp.Recv(tmp, ReadBufferSize)
-					if hr > 0 {
-						status := tmp[0]
-						if status == Data {
-							copy(ca.b, tmp[1:hr])
-							ca.c <- int(hr - 1)
-							break
-						} else {
-							session.DoAction("recv", status)
-						}
-					} else {
-						waitRecvCache = &ca
-						break
-					}
-				}
-			case action := <-session.do2:
-				switch action.t {
-				case "input":
-					session.overTime = time.Now().Unix() + session.timeout
-					args := action.args
-					s := args[0].([]byte)
-					n := args[1].(int)
-					if n < 5 {
-						log.Println("recv reset")
-						go session._Close(false)
-						break
-					} else if n == 5 {
-						status, _ := makeDecode(s)
-						if status == Reset || status == ResetAck {
-							log.Println("recv reset2", status)
-							go session._Close(false)
-						}
-						break
-					}
-					session.kcp.Input(s, n)
-					if waitRecvCache != nil {
-						ca := *waitRecvCache
-						tmp := session.processBuffer
-						for {
-							hr := session.kcp.Recv(tmp, ReadBufferSize)
-							if hr > 0 {
-								status := tmp[0]
-								if status == Data {
-									waitRecvCache = nil
-									copy(ca.b, tmp[1:hr])
-									ca.c <- int(hr - 1)
-									break
-								} else {
-									session.DoAction("recv", status)
-								}
-							} else {
-								break
-							}
-						}
-					}
-					updateF(10)
-				case "write":
-					b := action.args[0].([]byte)
-					session.kcp.Send(b, len(b))
-					updateF(10)
-				}
-			case <-session.quitChan:
-				break out
-			case <-updateC:
-				now := uint32(iclock())
-				session.kcp.Update(now)
-				callUpdate = false
+		}
+		return
+	}
+	session.kcp.Input(data, n)
+	if session.ticketOpts != nil {
+		//the dialer is through the handshake, our kcp packets can no
+		//longer be taken for its SndACK or ResumeACK
+		session.sendTicket(session.ticketOpts)
+		session.ticketOpts = nil
+	}
+	session.drain()
+	session.scheduleUpdate(10 * time.Millisecond)
+	session.wakeWriters()
+}
+
+// drain moves complete messages out of kcp, control frames are handled here
+func (session *UDPMakeSession) drain() {
+	if session.readPaused {
+		return
+	}
+	got := false
+	tmp := processBufferPool.Get().([]byte)
+	for len(session.rcvQueue) < recvQueueLimit && !session.isQuit() {
+		hr := session.kcp.Recv(tmp, ReadBufferSize)
+		if hr <= 0 {
+			break
+		}
+		got = true
+		if session.streamMode {
+			session.streamInput(tmp[:hr])
+		} else {
+			session.message(tmp[0], tmp[1:hr])
+		}
+	}
+	processBufferPool.Put(tmp)
+	if got {
+		broadcast(&session.readWake, session.readWaiting)
+		//the window may have opened again
+		session.scheduleUpdate(10 * time.Millisecond)
+	}
+}
+
+// message handles one message out of kcp, the lock must be held
+func (session *UDPMakeSession) message(status byte, payload []byte) {
+	if status == Data {
+		if session.readClosed {
+			return
+		}
+		b := make([]byte, len(payload))
+		copy(b, payload)
+		session.rcvQueue = append(session.rcvQueue, b)
+	} else if status == StreamFrame {
+		session.muxInput(payload)
+	} else if status == Ticket {
+		session.ticket = append([]byte(nil), payload...)
+	} else {
+		session.recv(status)
+	}
+}
+
+// sendMessage queues one message in kcp, data[0] is its status
+func (session *UDPMakeSession) sendMessage(data []byte) {
+	if session.pingsOnly {
+		//Pings resent while idle do not count against the dead link
+		session.pingsOnly = false
+		session.kcp.ResetXmit()
+		session.kcp.SetDeadLink(int32(session.deadLink))
+	}
+	if session.streamMode {
+		data = frameMessage(data)
+	}
+	session.kcp.Send(data, len(data))
+}
+
+func (session *UDPMakeSession) recv(status byte) {
+	switch status {
+	case CloseBack:
+		//A call from B
+		//log.Println("recv back close, step2", session.LocalAddr().String(), session.RemoteAddr().String())
+		session.closeOver()
+	case Close:
+		//log.Println("recv remote close, step1", session.LocalAddr().String(), session.RemoteAddr().String())
+		session.sendFrame(CloseBack)
+		if !session.closed {
+			session.closed = true
+			//log.Println("close remote over, step4", session.LocalAddr().String(), session.RemoteAddr().String())
+			session.closeTimer.reset(closeWait)
+		}
+	case Reset:
+		log.Println("recv reset")
+		session.closeOver()
+	case Fin:
+		//everything the peer wrote is queued before this, Read gives io.EOF after it
+		session.finRecv = true
+	case Ping:
+	}
+}
+
+func (session *UDPMakeSession) sendFrame(status byte) {
+	buf := make([]byte, 5)
+	session.sendMessage(makeEncode(buf, status, 0))
+	session.scheduleUpdate(10 * time.Millisecond)
+}
+
+func (session *UDPMakeSession) scheduleUpdate(d time.Duration) {
+	if !session.updating {
+		session.updating = true
+		session.updateTimer.reset(d)
+	}
+}
+
+func (session *UDPMakeSession) onUpdate() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.updating = false
+	if session.isQuit() {
+		return
+	}
+	now := ikcp.Millis(session.wheel.now())
+	session.kcp.Update(now)
+	if session.kcp.IsDead() {
+		session.deadClose()
+		return
+	}
+	if session.kcp.Waitsnd() > 0 || session.kcp.Waitpace() > 0 || session.kcp.Waitack() > 0 {
+		//keep ticking only while something is in flight or held back
+		next := int32(session.kcp.Check(now) - now)
+		if next < 1 {
+			next = 1
+		}
+		session.scheduleUpdate(time.Duration(next) * time.Millisecond)
+	}
+	session.wakeWriters()
+}
+
+func (session *UDPMakeSession) onPing() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isQuit() {
+		return
+	}
+	now := session.wheel.now().UnixNano()
+	if now-session.lastRecv >= int64(session.idleTimeout) {
+		session.idleClose()
+		return
+	}
+	if now-session.lastPing >= int64(session.keepAlive) {
+		session.lastPing = now
+		if session.kcp.Waitsnd() <= dataLimit/2 {
+			idle := session.pingsOnly || session.kcp.Waitsnd() == 0
+			session.sendFrame(Ping)
+			if idle {
+				//a peer gone while we are idle is the idle timeout's to find,
+				//the dead link is back with the next thing we send
+				session.pingsOnly = true
+				session.kcp.SetDeadLink(math.MaxInt32)
 			}
 		}
-	}()
+	}
+	session.pingTimer.reset(session.nextPing(now))
+}
+
+func (session *UDPMakeSession) wakeWriters() {
+	if session.kcp.Waitsnd() <= dataLimit/2 {
+		broadcast(&session.writeWake, session.writeWaiting)
+	}
+}
+
+// broadcast wakes everyone waiting on *c
+func broadcast(c *chan bool, waiting int) {
+	if waiting > 0 {
+		close(*c)
+		*c = make(chan bool)
+	}
+}
+
+func (session *UDPMakeSession) isQuit() bool {
 	select {
-	case ping <- true:
 	case <-session.quitChan:
+		return true
+	default:
+		return false
 	}
-out:
-	for {
-		select {
-		case action := <-session.do:
-			switch action.t {
-			case "quit":
-				if session.closed {
-					break
-				}
-				session._Close(true)
-			case "closebegin":
-				//A tell B to close and wait
-				time.AfterFunc(time.Millisecond*500, func() {
-					//log.Println("close over, step3", session.LocalAddr().String(), session.RemoteAddr().String())
-					go session.DoAction("closeover")
-				})
-				buf := make([]byte, 5)
-				go session.DoWrite(makeEncode(buf, Close, 0))
-			case "closeover":
-				//A call timeover
-				close(session.closeChan)
-				break out
-			case "closeend":
-				//B call close
-				session._Close(false)
-				break out
-			case "recv":
-				status := (action.args[0]).(byte)
-				switch status {
-				case CloseBack:
-					//A call from B
-					//log.Println("recv back close, step2", session.LocalAddr().String(), session.RemoteAddr().String())
-					go session.DoAction("closeover")
-				case Close:
-					if session.closed {
-						break
-					}
-					if session.status != "ok" {
-						session._Close(false)
-					} else {
-						//log.Println("recv remote close, step1", session.LocalAddr().String(), session.RemoteAddr().String())
-						buf := make([]byte, 5)
-						go session.DoWrite(makeEncode(buf, CloseBack, 0))
-						time.AfterFunc(time.Millisecond*500, func() {
-							//log.Println("close remote over, step4", session.LocalAddr().String(), session.RemoteAddr().String())
-							if session.closed {
-								return
-							}
-							go session.DoAction("closeend")
-						})
-					}
-				case Reset:
-					log.Println("recv reset")
-					go session._Close(false)
-				case Ping:
-				default:
-					if session.status != "ok" {
-						session.Close()
-					}
-				}
-			}
+}
+
+// wait releases the lock until c is closed, the session quits or deadline passes
+func (session *UDPMakeSession) wait(c chan bool, deadline time.Time) error {
+	var timeout chan bool
+	if !deadline.IsZero() {
+		d := deadline.Sub(session.wheel.now())
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
 		}
+		timeout = make(chan bool)
+		t := session.wheel.clock.AfterFunc(d, func() { close(timeout) })
+		defer t.Stop()
+	}
+	session.lock.Unlock()
+	defer session.lock.Lock()
+	select {
+	case <-c:
+	case <-session.quitChan:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
 	}
+	return nil
 }
 
-func (session *UDPMakeSession) _Close(bFirstCall bool) {
+func (session *UDPMakeSession) readErr() error {
+	if session.closeErr != nil {
+		return session.closeErr
+	}
+	return errReadQuit
+}
+
+func (session *UDPMakeSession) writeErr() error {
+	if session.closeErr != nil {
+		return session.closeErr
+	}
+	return errClosed
+}
+
+// closeBegin sends Close and gives the peer closeWait to answer, the lock must be held
+func (session *UDPMakeSession) closeBegin() {
 	if session.closed {
 		return
 	}
 	session.closed = true
-	//session.wait.Wait()
-	go func() {
-		//log.Println("pipe begin close", session.LocalAddr().String(), session.RemoteAddr().String())
-		if bFirstCall {
-			go session.DoAction("closebegin", session.LocalAddr().String())
-			<-session.closeChan
-		} else {
-			close(session.closeChan)
-		}
-		//log.Println("pipe end close", session.id)
-		close(session.quitChan)
-		if session.listener != nil {
-			session.listener.remove(session.remote.String())
-		} else {
-			if session.sock != nil {
-				session.sock.Close()
-			}
+	if session.status != "ok" {
+		session.closeOver()
+		return
+	}
+	//log.Println("pipe begin close", session.LocalAddr().String(), session.RemoteAddr().String())
+	session.sendFrame(Close)
+	session.closeTimer.reset(closeWait)
+}
+
+func (session *UDPMakeSession) closeOverLocked() {
+	session.lock.Lock()
+	session.closeOver()
+	session.lock.Unlock()
+}
+
+// closeOver tears the session down for good, the lock must be held
+func (session *UDPMakeSession) closeOver() {
+	if session.isQuit() {
+		return
+	}
+	//log.Println("pipe end close", session.id)
+	session.closed = true
+	close(session.quitChan)
+	session.updateTimer.stop()
+	session.pingTimer.stop()
+	session.handshakeTimer.stop()
+	session.closeTimer.stop()
+	if session.pmtud != nil && session.pmtud.timer != nil {
+		session.pmtud.timer.stop()
+	}
+	if session.kcp != nil {
+		//what it held goes back to the listener's pool
+		session.kcp.SetAutoTune(0, nil)
+	}
+	if session.shard != nil {
+		session.shard.remove(session)
+	} else {
+		if session.sock != nil {
+			session.sock.Close()
 		}
-	}()
+		releaseClientWheel(session.wheel)
+	}
 }
 
 func (session *UDPMakeSession) Close() error {
+	session.lock.Lock()
 	if session.closed {
+		session.lock.Unlock()
 		return nil
 	}
-	if session.status != "ok" {
-		session._Close(false)
+	session.closeBegin()
+	session.lock.Unlock()
+	<-session.quitChan
+	return nil
+}
+
+// CloseWrite sends Fin after the queued data, the peer's Read returns
+// io.EOF once it read everything while it can still write back. Peers that
+// only speak 0.1 do not know Fin
+func (session *UDPMakeSession) CloseWrite() error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.status != "ok" || session.closed {
+		return errClosed
+	}
+	if session.version < framesVersion {
+		return errOldVersion
+	}
+	if session.finSent {
 		return nil
 	}
-	go session.DoAction("quit")
-	<-session.closeChan
+	session.finSent = true
+	session.sendFrame(Fin)
+	broadcast(&session.writeWake, session.writeWaiting)
 	return nil
 }
 
-func (session *UDPMakeSession) DoAction2(action string, args ...interface{}) {
-	//session.wait.Add(1)
-	//log.Println(action, len(args))
-	select {
-	case session.do2 <- Action{t: action, args: args}:
-	case <-session.quitChan:
-		//session.wait.Done()
+// CloseRead drops what was received and what comes later, Read returns io.EOF,
+// streams and datagrams are not affected
+func (session *UDPMakeSession) CloseRead() error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isQuit() {
+		return errClosed
 	}
+	session.readClosed = true
+	session.readPaused = false
+	session.rcvQueue = nil
+	//keep draining so the window stays open for streams and control frames
+	session.drain()
+	broadcast(&session.readWake, session.readWaiting)
+	return nil
 }
-func (session *UDPMakeSession) DoAction(action string, args ...interface{}) {
-	//session.wait.Add(1)
-	//log.Println(action, len(args))
-	select {
-	case session.do <- Action{t: action, args: args}:
-	case <-session.quitChan:
-		//session.wait.Done()
+
+// PauseRead stops taking data out of kcp, once its queue fills the window
+// the session advertises goes to zero and the peer stops sending, probing
+// until ResumeRead. Everything that comes through kcp waits, streams and
+// control frames from the peer as well, Read still returns what is queued
+func (session *UDPMakeSession) PauseRead() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.readPaused = true
+}
+
+// ResumeRead drains kcp again, the freed window goes to the peer right away
+func (session *UDPMakeSession) ResumeRead() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.readPaused {
+		return
+	}
+	session.readPaused = false
+	if session.kcp != nil && !session.isQuit() {
+		session.drain()
+		session.scheduleUpdate(time.Millisecond)
+	}
+}
+
+// SetCongestionController turns congestion control on with cc, for example
+// ikcp.NewRenoController() or ikcp.NewBBRController() on long fat links,
+// nil goes back to the default of no congestion window
+func (session *UDPMakeSession) SetCongestionController(cc ikcp.CongestionController) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.kcp == nil {
+		return
+	}
+	session.kcp.SetCongestionController(cc)
+	if cc == nil {
+		session.kcp.Nodelay(-1, -1, -1, 1)
+	} else {
+		session.kcp.Nodelay(-1, -1, -1, 0)
 	}
 }
 
-func (session *UDPMakeSession) processInput(s string, n int) {
+// SetPacing spreads the datagrams of a flush over time instead of sending
+// them in one burst, rate is in bytes per second, 0 paces at the estimated
+// bandwidth of the link
+func (session *UDPMakeSession) SetPacing(enable bool, rate uint32) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.kcp == nil {
+		return
+	}
+	session.kcp.SetPacing(enable, rate)
+	session.scheduleUpdate(time.Millisecond)
 }
 
 func (session *UDPMakeSession) LocalAddr() net.Addr {
@@ -770,69 +1174,102 @@ func (session *UDPMakeSession) LocalAddr() net.Addr {
 }
 
 func (session *UDPMakeSession) RemoteAddr() net.Addr {
-	return net.Addr(session.remote)
+	return session.remote
 }
 
 func (session *UDPMakeSession) SetDeadline(t time.Time) error {
-	return session.sock.SetDeadline(t)
+	session.lock.Lock()
+	session.readDeadline = t
+	session.writeDeadline = t
+	session.lock.Unlock()
+	return nil
 }
 
 func (session *UDPMakeSession) SetReadDeadline(t time.Time) error {
-	return session.sock.SetReadDeadline(t)
+	session.lock.Lock()
+	session.readDeadline = t
+	session.lock.Unlock()
+	return nil
 }
 
 func (session *UDPMakeSession) SetWriteDeadline(t time.Time) error {
-	return session.sock.SetWriteDeadline(t)
-}
-
-func (session *UDPMakeSession) DoWrite(s []byte) bool {
-	wc := make(chan bool)
-	select {
-	case session.checkCanWrite <- wc:
-		select {
-		case <-wc:
-		case <-session.quitChan:
-			return false
-		}
-		session.DoAction2("write", s)
-		return true
-	case <-session.quitChan:
-		return false
-	}
+	session.lock.Lock()
+	session.writeDeadline = t
+	session.lock.Unlock()
+	return nil
 }
 
 func (session *UDPMakeSession) Write(b []byte) (n int, err error) {
-	sendL := len(b)
-	if sendL == 0 || session.status != "ok" {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if len(b) == 0 || session.status != "ok" {
 		return 0, nil
 	}
-	data := make([]byte, sendL+1)
-	data[0] = Data
-	copy(data[1:], b)
-	ok := session.DoWrite(data)
-	if !ok {
-		return 0, errors.New("closed")
+	if session.finSent {
+		return 0, errWriteClosed
+	}
+	for len(b) > 0 {
+		for session.kcp.Waitsnd() > dataLimit && !session.closed && !session.finSent {
+			log.Println("wait for data limit")
+			session.writeWaiting++
+			err = session.wait(session.writeWake, session.writeDeadline)
+			session.writeWaiting--
+			if err != nil {
+				return
+			}
+		}
+		if session.closed {
+			return n, session.writeErr()
+		}
+		if session.finSent {
+			return n, errWriteClosed
+		}
+		sendL := len(b)
+		if sendL > dataLimit {
+			sendL = dataLimit
+		}
+		data := make([]byte, sendL+1)
+		data[0] = Data
+		copy(data[1:], b[:sendL])
+		session.sendMessage(data)
+		session.scheduleUpdate(10 * time.Millisecond)
+		n += sendL
+		b = b[sendL:]
 	}
-	return sendL, err
+	return n, nil
 }
 
-//udp read does not relay on the len(p), please make a big enough array to cache data
+// Read returns one message at most, what does not fit in p is kept for the next Read
 func (session *UDPMakeSession) Read(p []byte) (n int, err error) {
-	wc := cache{p, 0, make(chan int)}
-	select {
-	case session.recvChan <- wc:
-		select {
-		case n = <-wc.c:
-		case <-session.quitChan:
-			n = -1
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for {
+		if len(session.rcvQueue) > 0 {
+			b := session.rcvQueue[0]
+			n = copy(p, b)
+			if n < len(b) {
+				session.rcvQueue[0] = b[n:]
+			} else {
+				session.rcvQueue[0] = nil
+				session.rcvQueue = session.rcvQueue[1:]
+				if !session.isQuit() {
+					session.drain()
+				}
+			}
+			//log.Println("real recv", l, string(b[:l]))
+			return n, nil
+		}
+		if session.finRecv || session.readClosed {
+			return 0, io.EOF
+		}
+		if session.isQuit() {
+			return 0, session.readErr()
+		}
+		session.readWaiting++
+		err = session.wait(session.readWake, session.readDeadline)
+		session.readWaiting--
+		if err != nil {
+			return 0, err
 		}
-	case <-session.quitChan:
-		n = -1
-	}
-	//log.Println("real recv", l, string(b[:l]))
-	if n == -1 {
-		return 0, errors.New("force quit for read error")
-	} else {
-		return n, nil
 	}
 }
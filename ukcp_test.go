@@ -1,70 +1,308 @@
 package ukcp
 
 import (
-	"log"
+	"bytes"
+	"io"
+	"net"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/go-ukcp/ukcp/ukcptest"
 )
 
-func server() {
-	l, err := Listen("127.0.0.1:4444")
-	if err != nil {
-		log.Println("listen port fail", err.Error())
-		return
-	}
-	log.Println("listen", "ok")
+// echoServer answers every message of every session it accepts
+func echoServer(l *Listener) {
 	for {
 		conn, err := l.Accept()
-		log.Println(err, "connect")
+		if err != nil {
+			return
+		}
 		go func() {
+			defer conn.Close()
 			buff := make([]byte, 500)
 			for {
 				n, e := conn.Read(buff)
 				if e != nil {
-					break
+					return
 				}
-				log.Println("got", conn.RemoteAddr().String(), string(buff[:n]))
 				conn.Write(buff[:n])
 			}
-			log.Println("server begin close connection")
-			conn.Close()
-			log.Println("server close connection")
 		}()
 	}
-	log.Println("server quit")
 }
 
-func client() {
-	conn, e := Dial("127.0.0.1:4444")
-	if conn == nil {
-		log.Println("byebyte", e.Error())
-		return
-	}
-	log.Println("dial", "ok")
-	t := time.Tick(time.Second)
-	i := 0
+func TestNetwork(t *testing.T) {
+	network := ukcptest.NewNetwork(1)
+	network.SetDefault(ukcptest.Link{Loss: 0.1, Duplicate: 0.05, Reorder: 0.1, Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	lconn, err := network.Listen("server:4444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenPacket(lconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+	cconn, err := network.Listen("client:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialPacket(cconn, l.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	buff := make([]byte, 500)
-	for {
-		<-t
-		i++
+	for i := 0; i < 4; i++ {
 		for j := 0; j < 30; j++ {
-			conn.Write([]byte("hello world" + strconv.Itoa(i+j)))
+			conn.Write([]byte("hello world" + strconv.Itoa(i*30+j)))
 		}
-		log.Println("loop", i)
-		n, e := conn.Read(buff)
-		log.Println("get", string(buff[:n]))
-		if i == 4 {
-			conn.Close()
+		for j := 0; j < 30; j++ {
+			n, e := conn.Read(buff)
+			if e != nil {
+				t.Fatal("round", i, e)
+			}
+			if want := "hello world" + strconv.Itoa(i*30+j); string(buff[:n]) != want {
+				t.Fatalf("got %q, want %q", buff[:n], want)
+			}
 		}
-		if e != nil {
-			break
+	}
+}
+
+func TestLossyTransfer(t *testing.T) {
+	network := ukcptest.NewNetwork(2)
+	//kcp has no checksum, corruption is left to the fuzz targets
+	network.SetDefault(ukcptest.Link{Loss: 0.05, Reorder: 0.05, Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, Bandwidth: 4 << 20})
+	lconn, _ := network.Listen("server:0")
+	l, err := ListenPacket(lconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msg := make([]byte, 1<<20)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
 		}
+		conn.Write(msg)
+		conn.(*UDPMakeSession).CloseWrite()
+	}()
+	cconn, _ := network.Listen("client:0")
+	conn, err := DialPacket(cconn, l.Addr(), &Config{StreamMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	back, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, msg) {
+		t.Error("bad transfer", len(back))
+	}
+	if stats := network.Stats(); stats.Lost == 0 {
+		t.Errorf("nothing lost in %+v", stats)
 	}
-	log.Println("client quit")
 }
-func TestNetwork(t *testing.T) {
-	go server()
-	go client()
-	time.Sleep(10 * time.Second)
+
+func TestShardedListener(t *testing.T) {
+	l, err := (&ListenConfig{Shards: 4}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Skip("reuseport listen fail", err.Error())
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buff := make([]byte, 500)
+				for {
+					n, e := conn.Read(buff)
+					if e != nil {
+						return
+					}
+					conn.Write(buff[:n])
+				}
+			}()
+		}
+	}()
+	done := make(chan string)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			conn, e := DialTimeout(l.Addr().String(), 5)
+			if e != nil {
+				done <- e.Error()
+				return
+			}
+			defer conn.Close()
+			msg := "hello" + strconv.Itoa(i)
+			conn.Write([]byte(msg))
+			buff := make([]byte, 500)
+			n, e := conn.Read(buff)
+			if e != nil || string(buff[:n]) != msg {
+				done <- "bad echo " + msg
+				return
+			}
+			done <- ""
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if s := <-done; s != "" {
+			t.Error(s)
+		}
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		//the proxy idiom: copy until EOF, then pass the half-close on
+		io.Copy(conn, conn)
+		conn.(*UDPMakeSession).CloseWrite()
+	}()
+	conn, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := bytes.Repeat([]byte("half"), 50000)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(msg); err != errWriteClosed {
+		t.Error("write after CloseWrite", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	back, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, msg) {
+		t.Error("bad echo", len(back))
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	server := <-accepted
+	b := make([]byte, 100)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	server.Read(b)
+	server.Write([]byte("before"))
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(b); err != io.EOF {
+		t.Error("read after CloseRead", n, err)
+	}
+	//what comes later is dropped, the other direction goes on
+	server.Write([]byte("after"))
+	conn.Write([]byte("back"))
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "back" {
+		t.Fatal("write after CloseRead", string(b[:n]), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.lock.Lock()
+	queued := len(conn.rcvQueue)
+	conn.lock.Unlock()
+	if queued != 0 {
+		t.Error("data queued after CloseRead", queued)
+	}
+	if n, err := conn.Read(b); err != io.EOF {
+		t.Error("read after CloseRead", n, err)
+	}
+}
+
+func TestPauseRead(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msg := make([]byte, 1000)
+	accepted := make(chan *UDPMakeSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.(*UDPMakeSession)
+		for i := 0; i < 1000; i++ {
+			msg[0] = byte(i)
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	conn, err := DialTimeout(l.Addr().String(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.PauseRead()
+	server := <-accepted
+	time.Sleep(500 * time.Millisecond)
+	//the window shut, the rest waits on the server
+	conn.lock.Lock()
+	queued := len(conn.rcvQueue)
+	conn.lock.Unlock()
+	server.lock.Lock()
+	waiting := server.kcp.Waitsnd()
+	server.lock.Unlock()
+	if queued != 0 || waiting == 0 {
+		t.Fatal("still reading while paused", queued, waiting)
+	}
+	//far less than the 7s until the server probes the window
+	conn.ResumeRead()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, len(msg))
+	for i := 0; i < 1000; i++ {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(i, err)
+		}
+		if b[0] != byte(i) {
+			t.Fatal("out of order at", i)
+		}
+	}
 }
@@ -0,0 +1,102 @@
+package ukcptest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// FakeClock is an ikcp.Clock that only moves when Advance moves it, the
+// timers that come due run on the goroutine calling Advance
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	seq   uint64 //timers due at once run in the order they were made
+	f     func()
+}
+
+// NewFakeClock makes a clock standing at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once Advance went d past now, a d of 0 or less on the next Advance
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ikcp.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	c.seq++
+	t := &fakeTimer{clock: c, when: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock d forward, stopping at every timer on the way
+// to run it, timers those set run too if they are due by the end
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		next := -1
+		for i, t := range c.timers {
+			if t.when.After(end) {
+				continue
+			}
+			if next < 0 || t.when.Before(c.timers[next].when) ||
+				(t.when.Equal(c.timers[next].when) && t.seq < c.timers[next].seq) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		t := c.timers[next]
+		c.timers = append(c.timers[:next], c.timers[next+1:]...)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.lock.Unlock()
+}
+
+// Pending is the number of timers waiting
+func (c *FakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
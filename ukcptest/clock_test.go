@@ -0,0 +1,62 @@
+package ukcptest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	var fired []time.Duration
+	at := func() { fired = append(fired, c.Now().Sub(start)) }
+	c.AfterFunc(30*time.Millisecond, at)
+	c.AfterFunc(10*time.Millisecond, func() {
+		at()
+		//set from a timer and due within the same Advance
+		c.AfterFunc(5*time.Millisecond, at)
+	})
+	stopped := c.AfterFunc(20*time.Millisecond, func() { t.Error("stopped timer fired") })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("stop twice")
+	}
+	c.Advance(25 * time.Millisecond)
+	if len(fired) != 2 || fired[0] != 10*time.Millisecond || fired[1] != 15*time.Millisecond {
+		t.Fatal("fired at", fired)
+	}
+	if c.Now() != start.Add(25*time.Millisecond) || c.Pending() != 1 {
+		t.Error("after advance", c.Now(), c.Pending())
+	}
+	c.Advance(5 * time.Millisecond)
+	if len(fired) != 3 || fired[2] != 30*time.Millisecond {
+		t.Error("fired at", fired)
+	}
+}
+
+func TestFakeDeadline(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	n := NewNetworkClock(1, c)
+	n.SetDefault(Link{Latency: time.Second})
+	a, b := pair(t, n)
+	a.WriteTo([]byte("late"), b.LocalAddr())
+	b.SetReadDeadline(c.Now().Add(500 * time.Millisecond))
+	read := make(chan error)
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Advance(500 * time.Millisecond)
+	if err := <-read; err == nil {
+		t.Fatal("read before the latency")
+	}
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 10))
+		read <- err
+	}()
+	c.Advance(500 * time.Millisecond)
+	if err := <-read; err != nil {
+		t.Error("read after the latency", err)
+	}
+}
@@ -0,0 +1,147 @@
+package ukcptest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+var errInUse = errors.New("address already in use")
+
+type packet struct {
+	from Addr
+	data []byte
+}
+
+// Conn is a net.PacketConn attached to a Network
+type Conn struct {
+	network *Network
+	addr    Addr
+
+	lock          sync.Mutex
+	queue         []packet
+	wake          chan struct{} //closed and replaced when a reader should look again
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// wakeLocked lets blocked readers look at the queue and their deadline again
+func (c *Conn) wakeLocked() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *Conn) push(from Addr, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.queue = append(c.queue, packet{from, data})
+	c.wakeLocked()
+}
+
+// ReadFrom waits for a datagram, what does not fit in b is lost like with UDP
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.lock.Lock()
+	for {
+		if c.closed {
+			c.lock.Unlock()
+			return 0, nil, c.opError("read", net.ErrClosed)
+		}
+		if len(c.queue) > 0 {
+			p := c.queue[0]
+			c.queue[0] = packet{}
+			c.queue = c.queue[1:]
+			c.lock.Unlock()
+			return copy(b, p.data), p.from, nil
+		}
+		var t ikcp.Timer
+		if !c.readDeadline.IsZero() {
+			d := c.readDeadline.Sub(c.network.clock.Now())
+			if d <= 0 {
+				c.lock.Unlock()
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			t = c.network.clock.AfterFunc(d, c.timeout)
+		}
+		wake := c.wake
+		c.lock.Unlock()
+		<-wake
+		if t != nil {
+			t.Stop()
+		}
+		c.lock.Lock()
+	}
+}
+
+// timeout wakes readers to see their deadline passed
+func (c *Conn) timeout() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wakeLocked()
+}
+
+// WriteTo sends b to addr, which only has to print like an address on the network
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.lock.Unlock()
+	if closed {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if !deadline.IsZero() && !c.network.clock.Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+	c.network.send(c.addr, Addr(addr.String()), b)
+	return len(b), nil
+}
+
+// Close detaches the conn, datagrams still on the way to it are lost
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	c.queue = nil
+	c.wakeLocked()
+	c.lock.Unlock()
+	//the network locks itself before a conn when it delivers
+	c.network.remove(c)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	c.wakeLocked()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.addr.Network(), Addr: c.addr, Err: err}
+}
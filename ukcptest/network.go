@@ -0,0 +1,212 @@
+// Package ukcptest is an in-memory datagram network for testing ukcp
+// without sockets. Conns attached to a Network exchange datagrams by address
+// through links that lose, delay, reorder, duplicate, corrupt and throttle
+// them as told, from a seeded random source so a run can be repeated.
+// Listen and Dial run over it with ukcp.ListenPacket and ukcp.DialPacket,
+// on a FakeClock with Config.Clock for tests that take no wall time
+package ukcptest
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-ukcp/ukcp/ikcp"
+)
+
+// Link is what happens to datagrams going one way between two addresses,
+// the zero value delivers them all at once
+type Link struct {
+	// Loss, Duplicate, Corrupt and Reorder are chances between 0 and 1. A
+	// corrupted datagram has one byte flipped, a reordered one is held back
+	// by another Latency plus Jitter so that later ones overtake it
+	Loss      float64
+	Duplicate float64
+	Corrupt   float64
+	Reorder   float64
+	// Latency delays every datagram, Jitter adds up to that much more
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth is how many bytes a second leave, the rest queue up to
+	// Queue bytes and are dropped past it. 0 means no limit for either
+	Bandwidth int
+	Queue     int
+}
+
+// Stats counts datagrams over the whole network
+type Stats struct {
+	Sent       int //written to a known address
+	Lost       int //by Loss, or queued past Queue
+	Duplicated int
+	Corrupted  int
+	Delivered  int //put in the queue of a conn, duplicates count twice
+}
+
+// Addr is the address of a Conn, "host:port" like a UDP one
+type Addr string
+
+func (a Addr) Network() string { return "ukcptest" }
+func (a Addr) String() string  { return string(a) }
+
+// Network switches datagrams between its conns, it is safe to use from
+// several goroutines
+type Network struct {
+	lock     sync.Mutex
+	rand     *rand.Rand
+	clock    ikcp.Clock
+	conns    map[Addr]*Conn
+	link     Link
+	links    map[[2]Addr]*linkState
+	nextPort int
+	stats    Stats
+}
+
+// a direction between two addresses, with its own bandwidth queue
+type linkState struct {
+	link      Link
+	set       bool      //SetLink decided it, not the default
+	busyUntil time.Time //when the last queued datagram is through
+}
+
+// NewNetwork makes a network whose random choices follow seed, on the system clock
+func NewNetwork(seed int64) *Network {
+	return NewNetworkClock(seed, ikcp.SystemClock)
+}
+
+// NewNetworkClock makes a network that delays datagrams and times out reads
+// on clock, the one the sessions over it use
+func NewNetworkClock(seed int64, clock ikcp.Clock) *Network {
+	return &Network{rand: rand.New(rand.NewSource(seed)), clock: clock, conns: make(map[Addr]*Conn), links: make(map[[2]Addr]*linkState), nextPort: 10000}
+}
+
+// SetDefault is the link of every direction SetLink did not set
+func (n *Network) SetDefault(l Link) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.link = l
+	for _, st := range n.links {
+		if !st.set {
+			st.link = l
+		}
+	}
+}
+
+// SetLink sets the link of datagrams going from one address to the other,
+// the way back keeps its own
+func (n *Network) SetLink(from, to net.Addr, l Link) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	st := n.linkLocked(Addr(from.String()), Addr(to.String()))
+	st.link = l
+	st.set = true
+}
+
+func (n *Network) linkLocked(from, to Addr) *linkState {
+	key := [2]Addr{from, to}
+	st := n.links[key]
+	if st == nil {
+		st = &linkState{link: n.link}
+		n.links[key] = st
+	}
+	return st
+}
+
+// Stats is what the network did so far
+func (n *Network) Stats() Stats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stats
+}
+
+// Listen attaches a conn at addr, a host without a port or an empty port
+// gets a free one, an empty addr a host of its own as well
+func (n *Network) Listen(addr string) (*Conn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	host, port := addr, ""
+	if addr != "" {
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			host, port = h, p
+		}
+	} else {
+		host = "10.0.0." + strconv.Itoa(len(n.conns)%250+1)
+	}
+	if port == "" || port == "0" {
+		n.nextPort++
+		port = strconv.Itoa(n.nextPort)
+	}
+	a := Addr(net.JoinHostPort(host, port))
+	if n.conns[a] != nil {
+		return nil, &net.OpError{Op: "listen", Net: a.Network(), Addr: a, Err: errInUse}
+	}
+	c := &Conn{network: n, addr: a, wake: make(chan struct{})}
+	n.conns[a] = c
+	return c, nil
+}
+
+// send takes a datagram from a conn, it is dropped quietly like UDP would
+// if nothing listens at to
+func (n *Network) send(from, to Addr, b []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	dst := n.conns[to]
+	if dst == nil {
+		return
+	}
+	n.stats.Sent++
+	st := n.linkLocked(from, to)
+	l := &st.link
+	if l.Loss > 0 && n.rand.Float64() < l.Loss {
+		n.stats.Lost++
+		return
+	}
+	now := n.clock.Now()
+	delay := l.Latency
+	if l.Bandwidth > 0 {
+		if st.busyUntil.Before(now) {
+			st.busyUntil = now
+		}
+		backlog := int64(st.busyUntil.Sub(now)) * int64(l.Bandwidth) / int64(time.Second)
+		if l.Queue > 0 && backlog+int64(len(b)) > int64(l.Queue) {
+			n.stats.Lost++
+			return
+		}
+		st.busyUntil = st.busyUntil.Add(time.Duration(int64(len(b)) * int64(time.Second) / int64(l.Bandwidth)))
+		delay += st.busyUntil.Sub(now)
+	}
+	copies := 1
+	if l.Duplicate > 0 && n.rand.Float64() < l.Duplicate {
+		n.stats.Duplicated++
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		d := delay
+		if l.Jitter > 0 {
+			d += time.Duration(n.rand.Int63n(int64(l.Jitter)))
+		}
+		if l.Reorder > 0 && n.rand.Float64() < l.Reorder {
+			d += l.Latency + l.Jitter
+		}
+		p := append([]byte(nil), b...)
+		if len(p) > 0 && l.Corrupt > 0 && n.rand.Float64() < l.Corrupt {
+			n.stats.Corrupted++
+			p[n.rand.Intn(len(p))] ^= byte(1 + n.rand.Intn(255))
+		}
+		n.stats.Delivered++
+		if d <= 0 {
+			dst.push(from, p)
+		} else {
+			n.clock.AfterFunc(d, func() { dst.push(from, p) })
+		}
+	}
+}
+
+func (n *Network) remove(c *Conn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.conns[c.addr] == c {
+		delete(n.conns, c.addr)
+	}
+}
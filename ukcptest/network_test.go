@@ -0,0 +1,158 @@
+package ukcptest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func pair(t *testing.T, n *Network) (a, b *Conn) {
+	a, err := n.Listen("a:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = n.Listen("b:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// drain reads what arrives until nothing did for wait
+func drain(c *Conn, wait time.Duration) [][]byte {
+	var got [][]byte
+	buf := make([]byte, 100)
+	for {
+		c.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return got
+		}
+		got = append(got, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	n := NewNetwork(1)
+	a, b := pair(t, n)
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	m, from, err := b.ReadFrom(buf)
+	if err != nil || string(buf[:m]) != "hel" || from.String() != a.LocalAddr().String() {
+		t.Fatal("read", m, from, err)
+	}
+	//nobody there, lost like with UDP
+	if _, err := a.WriteTo([]byte("x"), Addr("c:1")); err != nil {
+		t.Error("write to nobody", err)
+	}
+	if _, err := n.Listen(a.LocalAddr().String()); err == nil {
+		t.Error("address taken twice")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	a, _ := pair(t, NewNetwork(1))
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err := a.ReadFrom(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("read past the deadline", err)
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Error("not a timeout", err)
+	}
+	//a blocked read sees Close
+	a.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a.Close()
+	}()
+	if _, _, err := a.ReadFrom(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Error("read after close", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	n := NewNetwork(1)
+	a, b := pair(t, n)
+	n.SetLink(a.LocalAddr(), b.LocalAddr(), Link{Loss: 0.2, Duplicate: 0.1, Corrupt: 0.1})
+	msg := []byte("0123456789")
+	for i := 0; i < 1000; i++ {
+		a.WriteTo(msg, b.LocalAddr())
+	}
+	got := drain(b, 50*time.Millisecond)
+	stats := n.Stats()
+	if stats.Sent != 1000 || len(got) != stats.Delivered || stats.Delivered != 1000-stats.Lost+stats.Duplicated {
+		t.Fatalf("%d read, %+v", len(got), stats)
+	}
+	if stats.Lost < 150 || stats.Lost > 250 || stats.Duplicated < 50 || stats.Corrupted < 50 {
+		t.Errorf("far from the chances: %+v", stats)
+	}
+	bad := 0
+	for _, p := range got {
+		if !bytes.Equal(p, msg) {
+			bad++
+		}
+	}
+	if bad != stats.Corrupted {
+		t.Error("corrupted", bad, stats.Corrupted)
+	}
+	//the way back is clean
+	b.WriteTo(msg, a.LocalAddr())
+	if got := drain(a, 50*time.Millisecond); len(got) != 1 {
+		t.Error("way back", len(got))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefault(Link{Latency: 50 * time.Millisecond, Reorder: 0.5})
+	a, b := pair(t, n)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	got := drain(b, 200*time.Millisecond)
+	if len(got) != 20 {
+		t.Fatal("got", len(got))
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Error("reordered ones came early", d)
+	}
+	inOrder := true
+	for i, p := range got {
+		inOrder = inOrder && p[0] == byte(i)
+	}
+	if inOrder {
+		t.Error("nothing reordered")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	n := NewNetwork(1)
+	//10 datagrams of 100 bytes a second fit in the queue
+	n.SetDefault(Link{Bandwidth: 1000, Queue: 1000})
+	a, b := pair(t, n)
+	msg := make([]byte, 100)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		a.WriteTo(msg, b.LocalAddr())
+	}
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.ReadFrom(buf); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Error("faster than the bandwidth", d)
+	}
+	if stats := n.Stats(); stats.Lost != 10 {
+		t.Errorf("queue overflow %+v", stats)
+	}
+}
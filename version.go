@@ -0,0 +1,94 @@
+package ukcp
+
+import "fmt"
+
+// Version is a wire format version, main in the high byte and sub in the low one
+type Version uint16
+
+// the range this package speaks, the dialer puts the upper end in the
+// FirstSYN arg where older releases look for it and the lower end after it,
+// the listener answers FirstACK with the highest version both sides have
+//
+//	FirstSYN: [FirstSYN][timeout][0][maxSub][maxMain][minMain][minSub]
+//	FirstACK: [FirstACK][id 4][main][sub]
+//
+// 0.2 adds the options of options.go after those
+const (
+	minVersion Version = Version(minMainV)<<8 | minSubV
+	maxVersion Version = Version(mainV)<<8 | subV
+)
+
+// from 0.5 on kcp acks with CMD_SACK ranges
+const sackVersion = Version(0)<<8 | 5
+
+const minMainV = 0
+const minSubV = 1
+
+func MakeVersion(main, sub byte) Version {
+	return Version(main)<<8 | Version(sub)
+}
+
+func (v Version) Main() byte {
+	return byte(v >> 8)
+}
+
+func (v Version) Sub() byte {
+	return byte(v)
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Main(), v.Sub())
+}
+
+// versions is the range the config allows, within what this package speaks
+func (c *Config) versions() (min, max Version) {
+	min, max = minVersion, maxVersion
+	if c.MinVersion > min {
+		min = c.MinVersion
+	}
+	if c.MaxVersion != 0 && c.MaxVersion < max {
+		max = c.MaxVersion
+	}
+	return
+}
+
+// pickVersion is the highest version in both ranges
+func pickVersion(min, max, peerMin, peerMax Version) (Version, bool) {
+	v := max
+	if peerMax < v {
+		v = peerMax
+	}
+	if v < min || v < peerMin {
+		return 0, false
+	}
+	return v, true
+}
+
+// peerVersions reads the range out of a FirstSYN, a peer that only sends
+// the arg speaks exactly that version
+func peerVersions(data []byte) (min, max Version) {
+	_, arg := makeDecode(data)
+	max = MakeVersion(byte(arg>>24), byte(arg>>16))
+	min = max
+	if len(data) >= 7 {
+		min = MakeVersion(data[5], data[6])
+	}
+	return
+}
+
+// Version is the wire format version the handshake settled on
+func (session *UDPMakeSession) Version() Version {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.version
+}
+
+func (session *UDPMakeSession) sendFirstACK() {
+	b := make([]byte, 7, 32)
+	makeEncode(b, FirstACK, session.id)
+	b[5], b[6] = session.version.Main(), session.version.Sub()
+	if session.version >= optionsVersion && session.opts != nil {
+		b = session.opts.encode(b)
+	}
+	session.sock.WriteTo(b, session.remote)
+}
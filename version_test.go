@@ -0,0 +1,136 @@
+package ukcp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickVersion(t *testing.T) {
+	v01, v02, v03, v10 := MakeVersion(0, 1), MakeVersion(0, 2), MakeVersion(0, 3), MakeVersion(1, 0)
+	cases := []struct {
+		min, max, peerMin, peerMax, want Version
+		ok                               bool
+	}{
+		{v01, v01, v01, v01, v01, true},
+		{v01, v03, v01, v02, v02, true},
+		{v01, v02, v01, v03, v02, true},
+		{v02, v03, v01, v01, 0, false},
+		{v01, v02, v03, v10, 0, false},
+		{v01, v10, v02, v10, v10, true},
+	}
+	for _, c := range cases {
+		v, ok := pickVersion(c.min, c.max, c.peerMin, c.peerMax)
+		if v != c.want || ok != c.ok {
+			t.Error(c.min, c.max, c.peerMin, c.peerMax, "=>", v, ok)
+		}
+	}
+	if s := MakeVersion(1, 12).String(); s != "1.12" {
+		t.Error("string", s)
+	}
+}
+
+func TestVersionHandshake(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	session, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if v := session.Version(); v != maxVersion {
+		t.Error("negotiated", v)
+	}
+	//nothing in common, the listener answers ResetAck
+	_, err = DialWithConfig(l.Addr().String(), &Config{MinVersion: maxVersion + 1})
+	if err == nil {
+		t.Error("dial without a common version")
+	}
+}
+
+// oldListenerConn reads FirstSYN like releases before ranges, only the arg
+type oldListenerConn struct {
+	net.PacketConn
+}
+
+func (c oldListenerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && n > 5 && b[0] == FirstSYN {
+		n = 5
+	}
+	return n, addr, err
+}
+
+func TestVersionDowngrade(t *testing.T) {
+	old := MakeVersion(0, 4)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := (&ListenConfig{Config: Config{MaxVersion: old}}).ListenPacket(oldListenerConn{conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	//the listener answers our highest with ResetAck and its own, which we speak
+	session, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if v := session.Version(); v != old {
+		t.Error("negotiated", v)
+	}
+	if _, err := session.Write([]byte("hi")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOldVersionFrames(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	session, err := DialWithConfig(l.Addr().String(), &Config{MaxVersion: minVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	//a 0.1 peer could not parse any of these
+	if _, err := session.OpenStream(); err != errOldVersion {
+		t.Error("stream", err)
+	}
+	if err := session.SendDatagram([]byte("hi")); err != errOldVersion {
+		t.Error("datagram", err)
+	}
+	if err := session.CloseWrite(); err != errOldVersion {
+		t.Error("fin", err)
+	}
+	if _, err := session.Write([]byte("hi")); err != nil {
+		t.Error(err)
+	}
+}